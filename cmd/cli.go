@@ -0,0 +1,500 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"goBlack/common"
+	"goBlack/pkg"
+	"goBlack/pkg/debrid"
+	"goBlack/pkg/server"
+	"io"
+	"net/http"
+	gourl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const dbPath = "blackhole.db"
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(config *common.Config, args []string) error
+}
+
+var commands = []command{
+	{"run", "", "start the daemon (the default)", runDaemon},
+	{"add", "<magnet|hash|file.torrent> -arr <name>", "send a torrent to an arr", runAdd},
+	{"list", "[-status s] [-arr a] [-active] [-since date] [-limit n] [-json]", "list torrents", runList},
+	{"show", "<id> [-json]", "show a torrent with its files and history", runShow},
+	{"retry", "<id>", "retry a failed or cancelled torrent", runRetry},
+	{"cancel", "<id>", "stop an active torrent (needs the daemon)", runCancel},
+	{"remove", "<id>", "delete a torrent from the debrid and the database", runRemove},
+	{"check-cache", "<hash|magnet>...", "check whether torrents are cached on the debrid", runCheckCache},
+	{"doctor", "", "check the config, connectivity, mounts and permissions", runDoctor},
+	{"db", "vacuum", "compact the database", runDB},
+}
+
+// Usage prints the subcommands
+func Usage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Usage: %s [-config file] <command> [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		_, _ = fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.usage, c.help)
+	}
+	_ = tw.Flush()
+	_, _ = fmt.Fprintln(w, "\nCommands use the API of a running daemon when server.api_key is set, and the\ndatabase directly otherwise.")
+}
+
+// Run runs a subcommand, the daemon if there is none
+func Run(config *common.Config, args []string) error {
+	if len(args) == 0 {
+		args = []string{"run"}
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(config, args[1:])
+		}
+	}
+	if args[0] == "help" {
+		Usage(os.Stdout)
+		return nil
+	}
+	Usage(os.Stderr)
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+// parseArgs parses flags wherever they are among the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func runDaemon(config *common.Config, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("run takes no arguments")
+	}
+	if err := config.CheckFolders(); err != nil {
+		return err
+	}
+	Start(config)
+	return nil
+}
+
+func findArrConfig(config *common.Config, name string) (*common.ArrConfig, error) {
+	names := make([]string, 0, len(config.Arrs))
+	for i := range config.Arrs {
+		if config.Arrs[i].Name == name {
+			return &config.Arrs[i], nil
+		}
+		names = append(names, config.Arrs[i].Name)
+	}
+	return nil, fmt.Errorf("unknown arr %q, configured arrs: %s", name, strings.Join(names, ", "))
+}
+
+func runAdd(config *common.Config, args []string) error {
+	fs := newFlagSet("add")
+	arrName := fs.String("arr", "", "arr to send the torrent to")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: add <magnet|hash|file.torrent> -arr <name>")
+	}
+	if *arrName == "" && len(config.Arrs) == 1 {
+		*arrName = config.Arrs[0].Name
+	}
+	arr, err := findArrConfig(config, *arrName)
+	if err != nil {
+		return err
+	}
+	input := positional[0]
+
+	api := newClient(config.Server)
+	if api.available() {
+		var resp struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := api.submit(arr.Name, input, &resp); err != nil {
+			return err
+		}
+		fmt.Printf("Added %s as %s\n", resp.Name, resp.Id)
+		return nil
+	}
+	path, err := queueInWatchFolder(arr, input)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Blackhole is not running, queued %s for when it starts\n", path)
+	return nil
+}
+
+// queueInWatchFolder puts a torrent in the watch folder of an arr, to be
+// picked up once the daemon runs
+func queueInWatchFolder(arr *common.ArrConfig, input string) (string, error) {
+	if strings.EqualFold(filepath.Ext(input), ".torrent") {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return "", err
+		}
+		if _, err := debrid.ParseTorrentFile(data); err != nil {
+			return "", fmt.Errorf("invalid torrent file: %w", err)
+		}
+		path := filepath.Join(arr.WatchFolder, filepath.Base(input))
+		return path, os.WriteFile(path, data, 0o644)
+	}
+	torrent, err := debrid.ParseMagnet(input)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(arr.WatchFolder, torrent.InfoHash+".magnet")
+	return path, os.WriteFile(path, []byte(torrent.Magnet+"\n"), 0o644)
+}
+
+func runList(config *common.Config, args []string) error {
+	fs := newFlagSet("list")
+	status := fs.String("status", "", "only torrents with this status")
+	arr := fs.String("arr", "", "only torrents of this arr")
+	active := fs.Bool("active", false, "only torrents still being processed")
+	since := fs.String("since", "", "only torrents added after this date or RFC 3339 time")
+	limit := fs.Int("limit", 50, "maximum number of torrents")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if positional, err := parseArgs(fs, args); err != nil {
+		return err
+	} else if len(positional) > 0 {
+		return fmt.Errorf("list takes no arguments")
+	}
+
+	var records []pkg.Record
+	api := newClient(config.Server)
+	if api.available() {
+		query := gourl.Values{
+			"limit":  {strconv.Itoa(*limit)},
+			"active": {strconv.FormatBool(*active)},
+		}
+		for key, value := range map[string]string{"status": *status, "arr": *arr, "since": *since} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		if err := api.get("torrents?"+query.Encode(), &records); err != nil {
+			return err
+		}
+	} else {
+		filter := pkg.Filter{Status: *status, Arr: *arr, Active: *active, Limit: *limit}
+		if *since != "" {
+			t, err := parseDate(*since)
+			if err != nil {
+				return fmt.Errorf("invalid since: %w", err)
+			}
+			filter.Since = t
+		}
+		common.InitDB(dbPath)
+		defer common.CloseDB()
+		var err error
+		if records, err = pkg.ListTorrents(filter); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		return printJSON(records)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tSTATUS\tARR\tPROGRESS\tADDED\tNAME")
+	for _, r := range records {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f%%\t%s\t%s\n", r.Id, r.Status, r.Arr, r.Progress, r.CreatedAt.Format(time.DateTime), r.Name)
+	}
+	return tw.Flush()
+}
+
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateOnly, value, time.Local)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func oneId(name string, args []string, fs *flag.FlagSet) (string, error) {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return "", err
+	}
+	if len(positional) != 1 {
+		return "", fmt.Errorf("usage: %s <id>", name)
+	}
+	return positional[0], nil
+}
+
+func runShow(config *common.Config, args []string) error {
+	fs := newFlagSet("show")
+	asJSON := fs.Bool("json", false, "print JSON")
+	id, err := oneId("show", args, fs)
+	if err != nil {
+		return err
+	}
+	var record *pkg.Record
+	api := newClient(config.Server)
+	if api.available() {
+		err = api.get("torrents/"+id, &record)
+	} else {
+		common.InitDB(dbPath)
+		defer common.CloseDB()
+		record, err = pkg.GetTorrent(id)
+	}
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(record)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fields := [][2]string{
+		{"ID", record.Id},
+		{"Name", record.Name},
+		{"Info hash", record.InfoHash},
+		{"Debrid id", record.DebridId},
+		{"Arr", record.Arr},
+		{"Status", record.Status},
+		{"Error", record.Error},
+		{"Progress", fmt.Sprintf("%.0f%%", record.Progress)},
+		{"Size", fmt.Sprintf("%d bytes", record.Size)},
+		{"Added", record.CreatedAt.Format(time.DateTime)},
+		{"Updated", record.UpdatedAt.Format(time.DateTime)},
+	}
+	for _, f := range fields {
+		if f[1] != "" {
+			_, _ = fmt.Fprintf(tw, "%s:\t%s\n", f[0], f[1])
+		}
+	}
+	if len(record.Files) > 0 {
+		_, _ = fmt.Fprintln(tw, "\nFiles:")
+		for _, f := range record.Files {
+			_, _ = fmt.Fprintf(tw, "  %s\t%d bytes\n", f.Path, f.Size)
+		}
+	}
+	if len(record.History) > 0 {
+		_, _ = fmt.Fprintln(tw, "\nHistory:")
+		for _, c := range record.History {
+			_, _ = fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.Time.Format(time.DateTime), c.Status, c.Error)
+		}
+	}
+	return tw.Flush()
+}
+
+func runRetry(config *common.Config, args []string) error {
+	id, err := oneId("retry", args, newFlagSet("retry"))
+	if err != nil {
+		return err
+	}
+	api := newClient(config.Server)
+	if api.available() {
+		if err := api.post("torrents/"+id+"/retry", nil); err != nil {
+			return err
+		}
+		fmt.Printf("Retrying %s\n", id)
+		return nil
+	}
+
+	// Without the daemon the magnet goes back into the watch folder
+	common.InitDB(dbPath)
+	defer common.CloseDB()
+	record, err := pkg.GetTorrent(id)
+	if err != nil {
+		return err
+	}
+	if record.Status != pkg.StatusFailed && record.Status != pkg.StatusCancelled {
+		return fmt.Errorf("only failed or cancelled torrents can be retried, torrent is %s", record.Status)
+	}
+	for i := range config.Arrs {
+		arr := &config.Arrs[i]
+		if arr.Name == record.Arr || (record.Arr == "" && arr.WatchFolder == record.WatchFolder) {
+			path, err := queueInWatchFolder(arr, record.Magnet)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Blackhole is not running, queued %s for when it starts\n", path)
+			return nil
+		}
+	}
+	return fmt.Errorf("arr %q of the torrent is not configured", record.Arr)
+}
+
+func runCancel(config *common.Config, args []string) error {
+	id, err := oneId("cancel", args, newFlagSet("cancel"))
+	if err != nil {
+		return err
+	}
+	api := newClient(config.Server)
+	if !api.available() {
+		return fmt.Errorf("blackhole is not running, nothing is active")
+	}
+	if err := api.post("torrents/"+id+"/cancel", nil); err != nil {
+		return err
+	}
+	fmt.Printf("Cancelling %s\n", id)
+	return nil
+}
+
+func runRemove(config *common.Config, args []string) error {
+	id, err := oneId("remove", args, newFlagSet("remove"))
+	if err != nil {
+		return err
+	}
+	api := newClient(config.Server)
+	if api.available() {
+		if err := api.do(http.MethodDelete, "torrents/"+id, "", nil, nil); err != nil {
+			return err
+		}
+	} else {
+		common.InitDB(dbPath)
+		defer common.CloseDB()
+		deb, arrs, err := newServices(config)
+		if err != nil {
+			return err
+		}
+		if err := NewJobs(deb, arrs).Delete(id); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Removed %s\n", id)
+	return nil
+}
+
+func runCheckCache(config *common.Config, args []string) error {
+	hashes, err := parseArgs(newFlagSet("check-cache"), args)
+	if err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return fmt.Errorf("usage: check-cache <hash|magnet>...")
+	}
+	common.InitDB(dbPath)
+	defer common.CloseDB()
+	deb, err := debrid.NewDebrid(config.Debrid)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "HASH\tCACHED\tVARIANTS\tCHECKED")
+	for _, input := range hashes {
+		torrent, err := debrid.ParseMagnet(input)
+		if err != nil {
+			return err
+		}
+		availability, err := deb.Availability().Check(torrent.InfoHash)
+		if err != nil {
+			return fmt.Errorf("%s: %w", torrent.InfoHash, err)
+		}
+		variants := 0
+		for _, files := range availability.Hosters {
+			variants += len(files)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%t\t%d\t%s\n", torrent.InfoHash, availability.Cached, variants, availability.CheckedAt.Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func runDoctor(config *common.Config, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("doctor takes no arguments")
+	}
+	// The settings were validated when the config was loaded, the folders are
+	// checked with the other dependencies below
+	fmt.Printf("ok    config: %s\n", config.Path)
+	common.InitDB(dbPath)
+	defer common.CloseDB()
+	deb, arrs, err := newServices(config)
+	if err != nil {
+		fmt.Printf("FAIL  config: %v\n", err)
+		return errors.New("some checks failed")
+	}
+
+	// The readiness check uses what the account monitor saw, the daemon isn't
+	// running it here
+	deb.Monitor().Check()
+	srv := server.New(config.Server)
+	registerChecks(srv, config, arrs, deb)
+	results, ok := srv.RunChecks(context.Background())
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result := results[name]
+		if result.Status == "ok" {
+			fmt.Printf("ok    %s\n", name)
+		} else {
+			fmt.Printf("FAIL  %s: %s\n", name, result.Error)
+		}
+	}
+
+	switch api := newClient(config.Server); {
+	case config.Server.APIKey == "":
+		fmt.Println("info  daemon: server.api_key is not set, commands work on the database directly")
+	case api.available():
+		fmt.Printf("info  daemon: running on %s\n", api.base)
+	default:
+		fmt.Printf("info  daemon: not running on %s\n", api.base)
+	}
+	if !ok {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
+
+func runDB(config *common.Config, args []string) error {
+	if len(args) != 1 || args[0] != "vacuum" {
+		return fmt.Errorf("usage: db vacuum")
+	}
+	before, _ := os.Stat(dbPath)
+	common.InitDB(dbPath)
+	defer common.CloseDB()
+	if _, err := common.GetDB().Exec("VACUUM"); err != nil {
+		return err
+	}
+	after, err := os.Stat(dbPath)
+	if err != nil {
+		return err
+	}
+	if before != nil {
+		fmt.Printf("Vacuumed %s: %d -> %d bytes\n", dbPath, before.Size(), after.Size())
+	} else {
+		fmt.Printf("Vacuumed %s: %d bytes\n", dbPath, after.Size())
+	}
+	return nil
+}
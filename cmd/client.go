@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goBlack/common"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// client talks to the API of a running daemon
+type client struct {
+	base   string
+	apiKey string
+	http   *http.Client
+}
+
+func newClient(conf common.ServerConfig) *client {
+	host, port, err := net.SplitHostPort(conf.Address)
+	if err != nil {
+		host, port = "", "8181"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return &client{
+		base:   "http://" + net.JoinHostPort(host, port),
+		apiKey: conf.APIKey,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// available reports whether the daemon is up and its API can be used
+func (c *client) available() bool {
+	if c.apiKey == "" {
+		return false
+	}
+	probe := &http.Client{Timeout: 2 * time.Second}
+	resp, err := probe.Get(c.base + "/healthz")
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (c *client) do(method, path, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequest(method, c.base+"/api/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", c.apiKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *client) get(path string, out any) error {
+	return c.do(http.MethodGet, path, "", nil, out)
+}
+
+func (c *client) post(path string, out any) error {
+	return c.do(http.MethodPost, path, "", nil, out)
+}
+
+// submit sends a magnet, info hash or .torrent file to an arr
+func (c *client) submit(arr, input string, out any) error {
+	if !strings.EqualFold(filepath.Ext(input), ".torrent") {
+		payload, err := json.Marshal(map[string]string{"arr": arr, "magnet": input})
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodPost, "torrents", "application/json", bytes.NewReader(payload), out)
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("arr", arr); err != nil {
+		return err
+	}
+	part, err := form.CreateFormFile("file", filepath.Base(input))
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "torrents", form.FormDataContentType(), &body, out)
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"goBlack/common"
+	"goBlack/pkg"
+	"goBlack/pkg/debrid"
+	"goBlack/pkg/server"
+	"net/http"
+	gourl "net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// registerChecks adds the readiness checks for every dependency of the daemon
+func registerChecks(srv *server.Server, config *common.Config, arrs []*pkg.Arr, deb debrid.Service) {
+	srv.AddCheck("database", checkDatabase)
+	token := &tokenCheck{deb: deb}
+	srv.AddCheck("debrid", func(ctx context.Context) error {
+		return checkDebrid(ctx, deb, token)
+	})
+	srv.AddCheck("mount", func(ctx context.Context) error {
+		return checkMount(config.Debrid.Folder)
+	})
+	for _, arr := range arrs {
+		addArrChecks(srv, arr)
+	}
+}
+
+var arrChecks = []string{"watch_folder:", "completed_folder:", "arr:"}
+
+func addArrChecks(srv *server.Server, arr *pkg.Arr) {
+	srv.AddCheck("watch_folder:"+arr.Name, func(ctx context.Context) error {
+		return common.CheckWritable(arr.WatchFolder)
+	})
+	srv.AddCheck("completed_folder:"+arr.Name, func(ctx context.Context) error {
+		return common.CheckWritable(arr.CompletedFolder)
+	})
+	srv.AddCheck("arr:"+arr.Name, func(ctx context.Context) error {
+		return checkArr(arr)
+	})
+}
+
+func removeArrChecks(srv *server.Server, name string) {
+	for _, prefix := range arrChecks {
+		srv.RemoveCheck(prefix + name)
+	}
+}
+
+func checkDatabase(ctx context.Context) error {
+	db := common.GetDB()
+	if db == nil {
+		return fmt.Errorf("database is not open")
+	}
+	var one int
+	return db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// checkDebrid reports the debrid as down while its breaker is open, while the
+// account has no premium, or when it rejects the API key
+func checkDebrid(ctx context.Context, deb debrid.Service, token *tokenCheck) error {
+	breaker := deb.Circuit()
+	if state := breaker.State(); state != common.CircuitClosed {
+		return fmt.Errorf("circuit to %s is %s", breaker.Host(), state)
+	}
+	if deb.Monitor().Expired() {
+		return debrid.ErrAccountExpired
+	}
+	return token.check(ctx)
+}
+
+// tokenTTL is how long the answer of the debrid about the API key is reused,
+// so readiness probes don't call it every few seconds
+const tokenTTL = 30 * time.Second
+
+// tokenCheck asks the debrid whether the API key works, at most once per
+// tokenTTL
+type tokenCheck struct {
+	deb       debrid.Service
+	mu        sync.Mutex // held during the call, concurrent probes wait for it
+	checkedAt time.Time
+	err       error
+}
+
+func (t *tokenCheck) check(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.checkedAt.IsZero() && time.Since(t.checkedAt) < tokenTTL {
+		return t.err
+	}
+	err := t.deb.CheckToken(ctx)
+	if ctx.Err() != nil {
+		// The probe gave up, that says nothing about the key
+		return err
+	}
+	t.err, t.checkedAt = err, time.Now()
+	return err
+}
+
+// checkMount makes sure the debrid folder is mounted. An unmounted mount point
+// is an empty directory.
+func checkMount(folder string) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%s is empty, the debrid is not mounted", folder)
+	}
+	return nil
+}
+
+func checkArr(arr *pkg.Arr) error {
+	url, err := gourl.JoinPath(arr.GetURL(), "system/status")
+	if err != nil {
+		return err
+	}
+	_, err = arr.Client.MakeRequest(http.MethodGet, url, nil)
+	return err
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"goBlack/pkg"
+	"goBlack/pkg/debrid"
+	"goBlack/pkg/server"
+	"log/slog"
+	"sync"
+)
+
+// Jobs runs torrents and keeps track of the active ones so they can be
+// cancelled, it is what the API acts on
+type Jobs struct {
+	deb    debrid.Service
+	mu     sync.Mutex
+	arrs   map[string]*pkg.Arr
+	active map[string]*pkg.Torrent
+	files  map[string]bool // watch files being processed
+}
+
+func NewJobs(deb debrid.Service, arrs []*pkg.Arr) *Jobs {
+	j := &Jobs{
+		deb:    deb,
+		active: make(map[string]*pkg.Torrent),
+		files:  make(map[string]bool),
+	}
+	j.setArrs(arrs)
+	return j
+}
+
+// setArrs replaces the arrs new torrents can be sent to. Active torrents keep
+// the arr they were started with.
+func (j *Jobs) setArrs(arrs []*pkg.Arr) {
+	byName := make(map[string]*pkg.Arr, len(arrs))
+	for _, arr := range arrs {
+		byName[arr.Name] = arr
+	}
+	j.mu.Lock()
+	j.arrs = byName
+	j.mu.Unlock()
+}
+
+// start processes a torrent in the background, unless it is already running
+func (j *Jobs) start(arr *pkg.Arr, torrent *pkg.Torrent) error {
+	j.mu.Lock()
+	if _, ok := j.active[torrent.Id]; ok {
+		j.mu.Unlock()
+		return fmt.Errorf("%w: torrent is already being processed", server.ErrConflict)
+	}
+	j.active[torrent.Id] = torrent
+	j.mu.Unlock()
+
+	torrent.Arr = arr
+	go func() {
+		defer func() {
+			j.mu.Lock()
+			delete(j.active, torrent.Id)
+			j.mu.Unlock()
+		}()
+		processTorrent(arr, j.deb, torrent)
+	}()
+	return nil
+}
+
+// claimFile reports whether a watch file isn't processed already, and marks
+// it as processed until releaseFile. A watcher started again finds the files
+// of the running jobs in its folder.
+func (j *Jobs) claimFile(path string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.files[path] {
+		return false
+	}
+	j.files[path] = true
+	return true
+}
+
+func (j *Jobs) releaseFile(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.files, path)
+}
+
+func (j *Jobs) isActive(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.active[id]
+	return ok
+}
+
+// Submit processes a torrent that didn't come from a watch folder
+func (j *Jobs) Submit(arrName string, torrent *pkg.Torrent) error {
+	j.mu.Lock()
+	arr, ok := j.arrs[arrName]
+	j.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", server.ErrUnknownArr, arrName)
+	}
+	torrent.Logger().Info("Torrent submitted through the API", "arr", arr.Name, "name", torrent.Name)
+	return j.start(arr, torrent)
+}
+
+// Retry processes a failed or cancelled torrent again from its magnet. A
+// .torrent file isn't kept, so private trackers have to be in the magnet.
+func (j *Jobs) Retry(id string) error {
+	record, err := pkg.GetTorrent(id)
+	if err != nil {
+		return err
+	}
+	if record.Status != pkg.StatusFailed && record.Status != pkg.StatusCancelled {
+		return fmt.Errorf("%w: only failed or cancelled torrents can be retried, torrent is %s", server.ErrConflict, record.Status)
+	}
+	arr := j.findArr(record)
+	if arr == nil {
+		return fmt.Errorf("%w: %q", server.ErrUnknownArr, record.Arr)
+	}
+	torrent, err := debrid.ParseMagnet(record.Magnet)
+	if err != nil {
+		return err
+	}
+	torrent.Id = record.Id
+	torrent.Status = record.Status
+	if record.Name != "" {
+		torrent.Name = record.Name
+	}
+	torrent.Logger().Info("Retrying torrent", "arr", arr.Name, "name", torrent.Name)
+	return j.start(arr, torrent)
+}
+
+// findArr returns the arr a torrent was processed for. Torrents saved before
+// the arr name was recorded are matched on their watch folder.
+func (j *Jobs) findArr(record *pkg.Record) *pkg.Arr {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if record.Arr != "" {
+		return j.arrs[record.Arr]
+	}
+	for _, arr := range j.arrs {
+		if arr.WatchFolder == record.WatchFolder {
+			return arr
+		}
+	}
+	return nil
+}
+
+// Cancel stops an active torrent, it is removed from the debrid once the job
+// notices
+func (j *Jobs) Cancel(id string) error {
+	j.mu.Lock()
+	torrent, ok := j.active[id]
+	j.mu.Unlock()
+	if !ok {
+		if _, err := pkg.GetTorrent(id); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: torrent is not active", server.ErrConflict)
+	}
+	// The job owns the torrent, only its id is safe to read here
+	slog.Info("Cancelling torrent", "torrent_id", id)
+	torrent.Cancel()
+	return nil
+}
+
+// Delete removes a torrent from the debrid and the database. Active torrents
+// have to be cancelled first.
+func (j *Jobs) Delete(id string) error {
+	if j.isActive(id) {
+		return fmt.Errorf("%w: torrent is active, cancel it first", server.ErrConflict)
+	}
+	record, err := pkg.GetTorrent(id)
+	if err != nil {
+		return err
+	}
+	if record.DebridId != "" {
+		torrent := &pkg.Torrent{Id: record.Id, DebridId: record.DebridId, InfoHash: record.InfoHash, Name: record.Name}
+		if err := j.deb.DeleteTorrent(torrent); err != nil {
+			// It may have been removed from the debrid already
+			torrent.Logger().Warn("Error deleting torrent from debrid", "error", err)
+		}
+	}
+	return pkg.DeleteTorrent(id)
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"goBlack/common"
+	"goBlack/pkg"
+	"goBlack/pkg/debrid"
+	"goBlack/pkg/notify"
+	"goBlack/pkg/server"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// configDebounce lets an editor finish writing the config before it is read
+	configDebounce = 1 * time.Second
+	// reauthInterval keeps jobs failing on a bad API key from rereading the
+	// config over and over
+	reauthInterval = 1 * time.Minute
+)
+
+// daemon holds what a config reload can change while blackhole runs
+type daemon struct {
+	mu         sync.Mutex // held while reloading
+	lastReauth time.Time
+	config     *common.Config
+	deb        debrid.Service
+	jobs       *Jobs
+	srv        *server.Server
+	watchers   map[string]*watcher // by arr name
+}
+
+// watcher is the running watch folder of an arr
+type watcher struct {
+	conf   common.ArrConfig
+	arr    *pkg.Arr
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (d *daemon) startWatcher(conf common.ArrConfig, arr *pkg.Arr) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watcher{conf: conf, arr: arr, cancel: cancel, done: make(chan struct{})}
+	d.watchers[arr.Name] = w
+	addArrChecks(d.srv, arr)
+	go func() {
+		defer close(w.done)
+		StartArr(ctx, arr, d.jobs)
+	}()
+}
+
+// stopWatcher stops watching the folder of an arr and waits for it, so the
+// folder can be watched again by the arr that replaces it
+func (d *daemon) stopWatcher(name string) {
+	w := d.watchers[name]
+	w.cancel()
+	<-w.done
+	delete(d.watchers, name)
+	removeArrChecks(d.srv, name)
+}
+
+// run reloads the config when it changes or on SIGHUP, it never returns
+func (d *daemon) run() {
+	// The path doesn't change, d.config is replaced by reloads on other goroutines
+	path := d.config.Path
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("Not watching the config file, reload it with SIGHUP", "error", err)
+	} else {
+		defer func() { _ = w.Close() }()
+		// Editors replace the file when saving, so its folder is watched
+		if err := w.Add(filepath.Dir(path)); err != nil {
+			slog.Warn("Not watching the config file, reload it with SIGHUP", "path", path, "error", err)
+		} else {
+			events, errs = w.Events, w.Errors
+		}
+	}
+	name := filepath.Base(path)
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config", "path", path)
+			d.reload()
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Base(event.Name) == name && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce = time.After(configDebounce)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			slog.Error("Error watching config file", "error", err)
+		case <-debounce:
+			debounce = nil
+			slog.Info("Config file changed, reloading", "path", path)
+			d.reload()
+		}
+	}
+}
+
+// reload applies a new config to the running daemon. Watch folders of added
+// and removed arrs are started and stopped, the debrid gets the new rate limit
+// and API key, and torrents being processed are left alone. A config that
+// doesn't load is logged and the running one is kept.
+func (d *daemon) reload() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	config, err := common.LoadConfig(d.config.Path)
+	if err == nil {
+		err = config.CheckFolders()
+	}
+	if err != nil {
+		slog.Error("Error reloading config, keeping the running one", "path", d.config.Path, "error", err)
+		return
+	}
+	config.Debrid = d.reloadDebrid(config.Debrid)
+	if config.Server != d.config.Server {
+		slog.Warn("Server settings changed, restart to apply them")
+		config.Server = d.config.Server
+	}
+
+	// Build everything before changing anything, so a bad arr keeps the old config
+	arrs := make([]*pkg.Arr, 0, len(config.Arrs))
+	changed := make(map[string]*pkg.Arr)
+	for _, conf := range config.Arrs {
+		if w, ok := d.watchers[conf.Name]; ok && reflect.DeepEqual(w.conf, conf) {
+			arrs = append(arrs, w.arr)
+			continue
+		}
+		arr, err := NewArr(config, conf)
+		if err != nil {
+			slog.Error("Error reloading config, keeping the running one", "path", d.config.Path, "error", fmt.Errorf("arr %s: %w", conf.Name, err))
+			return
+		}
+		arrs = append(arrs, arr)
+		changed[arr.Name] = arr
+	}
+	notifier, err := notify.New(config.Notifications)
+	if err != nil {
+		slog.Error("Error reloading config, keeping the running one", "path", d.config.Path, "error", err)
+		return
+	}
+
+	if err := common.SetupLogger(config.LogLevel, config.LogFormat); err != nil {
+		slog.Error("Error setting up logging", "error", err)
+	}
+	notify.SetNotifier(notifier)
+	d.deb.Reload(config.Debrid)
+
+	for name := range d.watchers {
+		if _, ok := changed[name]; ok || !hasArr(config, name) {
+			slog.Info("Stopping arr", "arr", name)
+			d.stopWatcher(name)
+		}
+	}
+	for i, conf := range config.Arrs {
+		if arr, ok := changed[conf.Name]; ok {
+			d.startWatcher(config.Arrs[i], arr)
+		}
+	}
+	d.jobs.setArrs(arrs)
+	d.config = config
+	slog.Info("Config reloaded", "path", config.Path, "arrs", len(arrs))
+}
+
+// reauth reloads the config when the debrid rejects the API key, which picks
+// up a key changed in the config or in its _FILE secret
+func (d *daemon) reauth() {
+	d.mu.Lock()
+	recent := time.Since(d.lastReauth) < reauthInterval
+	if !recent {
+		d.lastReauth = time.Now()
+	}
+	d.mu.Unlock()
+	if recent {
+		return
+	}
+	d.reload()
+}
+
+// reloadDebrid returns the debrid config to run with. Only the API key and
+// the rate limit change without a restart.
+func (d *daemon) reloadDebrid(dc common.DebridConfig) common.DebridConfig {
+	running := d.config.Debrid
+	running.APIKey, running.RateLimit = dc.APIKey, dc.RateLimit
+	if !reflect.DeepEqual(running, dc) {
+		slog.Warn("Debrid settings other than api_key and rate_limit changed, restart to apply them")
+	}
+	return running
+}
+
+func hasArr(config *common.Config, name string) bool {
+	for _, conf := range config.Arrs {
+		if conf.Name == name {
+			return true
+		}
+	}
+	return false
+}
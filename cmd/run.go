@@ -1,12 +1,18 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"goBlack/common"
 	"goBlack/pkg"
+	"goBlack/pkg/archive"
 	"goBlack/pkg/debrid"
-	"log"
+	"goBlack/pkg/notify"
+	"goBlack/pkg/selector"
+	"goBlack/pkg/server"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
@@ -18,7 +24,7 @@ func fileReady(path string) bool {
 	return !os.IsNotExist(err) // Returns true if the file exists
 }
 
-func checkFileLoop(wg *sync.WaitGroup, dir string, file pkg.File, ready chan<- pkg.File) {
+func checkFileLoop(ctx context.Context, wg *sync.WaitGroup, dir string, file pkg.File, ready chan<- pkg.File) {
 	defer wg.Done()
 	ticker := time.NewTicker(1 * time.Second) // Check every second
 	defer ticker.Stop()
@@ -30,20 +36,26 @@ func checkFileLoop(wg *sync.WaitGroup, dir string, file pkg.File, ready chan<- p
 				ready <- file
 				return
 			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func ProcessFiles(arr *pkg.Arr, torrent *pkg.Torrent) {
+// ProcessFiles waits for the files of a downloaded torrent on the mount and
+// links or extracts them into the completed folder
+func ProcessFiles(arr *pkg.Arr, torrent *pkg.Torrent) error {
+	_ = torrent.SetStatus(pkg.StatusLinking, nil)
+	start := time.Now()
 	var wg sync.WaitGroup
 	files := torrent.Files
 	ready := make(chan pkg.File, len(files))
 
-	log.Println("Checking files...")
+	torrent.Logger().Info("Waiting for files on the mount", "files", len(files))
 
 	for _, file := range files {
 		wg.Add(1)
-		go checkFileLoop(&wg, arr.Debrid.Folder, file, ready)
+		go checkFileLoop(torrent.Context(), &wg, arr.Debrid.Folder, file, ready)
 	}
 
 	go func() {
@@ -52,19 +64,36 @@ func ProcessFiles(arr *pkg.Arr, torrent *pkg.Torrent) {
 	}()
 
 	for r := range ready {
-		log.Println("File is ready:", r.Name)
-		CreateSymLink(arr, torrent)
-
+		torrent.Logger().Debug("File is ready", "file", r.Name)
+		if !torrent.Extract {
+			CreateSymLink(arr, torrent)
+		}
+	}
+	if err := torrent.Context().Err(); err != nil {
+		return err
 	}
+	common.MountWait.WithLabelValues(arr.Name).Observe(time.Since(start).Seconds())
+	common.StageDuration.WithLabelValues("mount", arr.Name, arr.Debrid.Name).Observe(time.Since(start).Seconds())
+	if torrent.Extract {
+		start = time.Now()
+		if err := ExtractArchives(arr, torrent); err != nil {
+			return fmt.Errorf("error extracting archives: %w", err)
+		}
+		common.StageDuration.WithLabelValues("extract", arr.Name, arr.Debrid.Name).Observe(time.Since(start).Seconds())
+	}
+	_ = torrent.SetStatus(pkg.StatusCompleted, nil)
+	common.TorrentsProcessed.WithLabelValues(arr.Name, arr.Debrid.Name).Inc()
+	notify.Notify(notify.TorrentEvent(notify.Linked, torrent, nil))
 	go torrent.Cleanup(true)
-	fmt.Printf("%s downloaded", torrent.Name)
+	torrent.Logger().Info("Torrent ready for import", "name", torrent.Name)
+	return nil
 }
 
 func CreateSymLink(config *pkg.Arr, torrent *pkg.Torrent) {
 	path := filepath.Join(config.CompletedFolder, torrent.Folder)
 	err := os.MkdirAll(path, os.ModePerm)
 	if err != nil {
-		log.Printf("Failed to create directory: %s\n", path)
+		torrent.Logger().Error("Failed to create directory", "path", path, "error", err)
 	}
 	for _, file := range torrent.Files {
 		// Combine the directory and filename to form a full path
@@ -75,107 +104,343 @@ func CreateSymLink(config *pkg.Arr, torrent *pkg.Torrent) {
 	}
 }
 
-func watchFiles(watcher *fsnotify.Watcher, events map[string]time.Time) {
+// ExtractArchives unpacks the archives of a torrent from the debrid mount into
+// the completed folder
+func ExtractArchives(arr *pkg.Arr, torrent *pkg.Torrent) error {
+	dest := filepath.Join(arr.CompletedFolder, torrent.Folder)
+	for _, file := range torrent.Files {
+		if !archive.IsFirstVolume(file.Name) {
+			continue
+		}
+		extracted, err := archive.Extract(filepath.Join(arr.Debrid.Folder, file.Path), dest)
+		if err != nil {
+			return err
+		}
+		torrent.Logger().Info("Extracted archive", "archive", file.Name, "files", len(extracted))
+	}
+	return nil
+}
+
+// pending holds the watch files until writes to them settle
+type pending struct {
+	mu    sync.Mutex
+	files map[string]time.Time
+}
+
+func newPending() *pending {
+	return &pending{files: make(map[string]time.Time)}
+}
+
+func (p *pending) touch(file string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.files[file]; !ok {
+		common.QueueDepth.WithLabelValues("watch").Inc()
+	}
+	p.files[file] = time.Now()
+}
+
+// settled removes and returns the files not written to for the period
+func (p *pending) settled(period time.Duration) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var files []string
+	for file, lastEventTime := range p.files {
+		if time.Since(lastEventTime) >= period {
+			files = append(files, file)
+			delete(p.files, file)
+			common.QueueDepth.WithLabelValues("watch").Dec()
+		}
+	}
+	return files
+}
+
+// clear drops the files of a watcher that is stopping. They stay in the
+// folder, and the watcher started for it next queues them again when it scans
+// the folder.
+func (p *pending) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	common.QueueDepth.WithLabelValues("watch").Sub(float64(len(p.files)))
+	clear(p.files)
+}
+
+func isWatchFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".torrent" || ext == ".magnet" || ext == ".txt"
+}
+
+// scanFolder queues the watch files already in a folder. They got no event,
+// they were written while blackhole wasn't running or by the CLI.
+func scanFolder(folder string, files *pending) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isWatchFile(entry.Name()) {
+			files.touch(filepath.Join(folder, entry.Name()))
+		}
+	}
+	return nil
+}
+
+func watchFiles(watcher *fsnotify.Watcher, files *pending) {
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				if filepath.Ext(event.Name) == ".torrent" || filepath.Ext(event.Name) == ".magnet" {
-					events[event.Name] = time.Now()
-				}
-
+			if event.Op&fsnotify.Write == fsnotify.Write && isWatchFile(event.Name) {
+				files.touch(event.Name)
 			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
 			}
-			log.Println("ERROR:", err)
+			slog.Error("Error watching files", "error", err)
 		}
 	}
 }
 
-func processFilesDebounced(arr *pkg.Arr, db debrid.Service, events map[string]time.Time, debouncePeriod time.Duration) {
+func processFilesDebounced(ctx context.Context, arr *pkg.Arr, jobs *Jobs, files *pending, debouncePeriod time.Duration) {
 	ticker := time.NewTicker(1 * time.Second) // Check every second
 	defer ticker.Stop()
 
-	for range ticker.C {
-		for file, lastEventTime := range events {
-			if time.Since(lastEventTime) >= debouncePeriod {
-				log.Printf("Torrent file detected: %s", file)
-				// Process the torrent file
-				torrent, err := db.Process(arr, file)
-				if err != nil || torrent == nil {
-					if torrent != nil {
-						// remove torrent file
-						torrent.Cleanup(true)
-						_ = torrent.MarkAsFailed()
-					}
-					log.Printf("Error processing torrent file: %s", err)
-				}
-				if err == nil && torrent != nil && len(torrent.Files) > 0 {
-					go ProcessFiles(arr, torrent)
-				}
-				delete(events, file) // remove file from channel
-
+	for {
+		select {
+		case <-ticker.C:
+			for _, file := range files.settled(debouncePeriod) {
+				// Uncached torrents can take hours, process each file on its own
+				go processFile(arr, jobs, file)
 			}
+		case <-ctx.Done():
+			files.clear()
+			return
 		}
 	}
 }
 
-func StartArr(conf *pkg.Arr, db debrid.Service) {
-	log.Printf("Watching: %s", conf.WatchFolder)
+func processFile(arr *pkg.Arr, jobs *Jobs, file string) {
+	if !jobs.claimFile(file) {
+		return
+	}
+	slog.Info("Torrent file detected", "file", file, "arr", arr.Name)
+	torrents, err := debrid.GetTorrents(file)
+	if err == nil {
+		torrents, err = skipHandled(file, torrents)
+	}
+	if err != nil || len(torrents) == 0 {
+		jobs.releaseFile(file)
+	}
+	if err != nil {
+		slog.Error("Error reading torrent file", "file", file, "arr", arr.Name, "error", err)
+		return
+	}
+	if len(torrents) == 0 {
+		slog.Info("Every torrent of the file was handled already, removing it", "file", file, "arr", arr.Name)
+		_ = os.Remove(file)
+		return
+	}
+	if len(torrents) > 1 {
+		slog.Info("Found several torrents in file", "file", file, "arr", arr.Name, "torrents", len(torrents))
+	}
+	source := pkg.NewSource(file, len(torrents), func() {
+		jobs.releaseFile(file)
+	})
+	for _, torrent := range torrents {
+		torrent.Source = source
+		// Ids are random, a new torrent can't collide with an active one
+		_ = jobs.start(arr, torrent)
+	}
+}
+
+// skipHandled drops the torrents of a watch file that completed or are
+// running already, which happens when the file was kept for another of its
+// torrents that failed
+func skipHandled(file string, torrents []*pkg.Torrent) ([]*pkg.Torrent, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	handled, err := pkg.HandledHashes(file, info.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	remaining := torrents[:0]
+	for _, torrent := range torrents {
+		if handled[torrent.InfoHash] {
+			torrent.Logger().Info("Skipping torrent handled from this file already", "file", file)
+			continue
+		}
+		remaining = append(remaining, torrent)
+	}
+	return remaining, nil
+}
+
+func processTorrent(arr *pkg.Arr, db debrid.Service, torrent *pkg.Torrent) {
+	common.QueueDepth.WithLabelValues("jobs").Inc()
+	defer common.QueueDepth.WithLabelValues("jobs").Dec()
+	torrent, err := db.Process(torrent)
+	if err == nil && len(torrent.Files) > 0 {
+		err = ProcessFiles(arr, torrent)
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		cancelTorrent(db, torrent)
+	case err != nil:
+		failTorrent(torrent, err)
+	case len(torrent.Files) == 0:
+		torrent.Cleanup(true)
+	}
+}
+
+// cancelTorrent removes a torrent cancelled through the API from the debrid
+func cancelTorrent(db debrid.Service, torrent *pkg.Torrent) {
+	torrent.Logger().Info("Torrent cancelled", "name", torrent.Name)
+	if torrent.DebridId != "" {
+		if err := db.DeleteTorrent(torrent); err != nil {
+			torrent.Logger().Warn("Error deleting cancelled torrent from debrid", "error", err)
+		}
+	}
+	_ = torrent.SetStatus(pkg.StatusCancelled, nil)
+	torrent.Cleanup(true)
+}
+
+// failTorrent reports a failed torrent and tells its arr to look for another
+// release, unless the debrid account is what failed, then the watch file is
+// kept to try again once it is fixed
+func failTorrent(torrent *pkg.Torrent, err error) {
+	torrent.Logger().Error("Error processing torrent", "name", torrent.Name, "error", err)
+	_ = torrent.SetStatus(pkg.StatusFailed, err)
+	common.TorrentsFailed.WithLabelValues(torrent.Arr.Name, torrent.Arr.Debrid.Name).Inc()
+	notify.Notify(notify.TorrentEvent(notify.Failed, torrent, err))
+	if debrid.IsAccountError(err) {
+		// The grab isn't lost, the watch file is processed again on the next start
+		torrent.Logger().Warn("Not failing the release in the arr and keeping the watch file, the debrid account needs fixing")
+		torrent.Cleanup(false)
+		return
+	}
+	// remove torrent file
+	torrent.Cleanup(true)
+	_ = torrent.MarkAsFailed()
+}
+
+// StartArr watches the watch folder of an arr until the context is cancelled.
+// Watch files already in the folder are processed too. Torrents already sent
+// to the debrid keep running.
+func StartArr(ctx context.Context, conf *pkg.Arr, jobs *Jobs) {
+	slog.Info("Watching", "folder", conf.WatchFolder, "arr", conf.Name)
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Error creating watcher", "arr", conf.Name, "error", err)
+		return
 	}
 	defer func(w *fsnotify.Watcher) {
 		err := w.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.Error("Error closing watcher", "error", err)
 		}
 	}(w)
-	events := make(map[string]time.Time)
+	files := newPending()
 
-	go watchFiles(w, events)
+	go watchFiles(w, files)
 	if err = w.Add(conf.WatchFolder); err != nil {
-		log.Println("Error Watching folder:", err)
+		slog.Error("Error watching folder", "folder", conf.WatchFolder, "arr", conf.Name, "error", err)
 		return
 	}
+	if err = scanFolder(conf.WatchFolder, files); err != nil {
+		slog.Error("Error reading watch folder", "folder", conf.WatchFolder, "arr", conf.Name, "error", err)
+	}
 
-	processFilesDebounced(conf, db, events, 1*time.Second)
+	processFilesDebounced(ctx, conf, jobs, files, 1*time.Second)
+	slog.Info("Stopped watching", "folder", conf.WatchFolder, "arr", conf.Name)
 }
 
-func StartArrs(config *common.Config, deb debrid.Service) {
-	var wg sync.WaitGroup
+// NewArr builds an arr from its config
+func NewArr(config *common.Config, conf common.ArrConfig) (*pkg.Arr, error) {
+	headers := map[string]string{
+		"X-Api-Key": conf.Token,
+	}
+	tr, err := common.NewTransport(conf.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	if conf.HTTP.InsecureSkipVerify {
+		slog.Warn("TLS certificates of the arr are not verified", "arr", conf.Name)
+	}
+	client := common.NewRLHTTPClient(nil, headers, common.WithTransport(tr))
+	sel, err := selector.New(conf.Selection)
+	if err != nil {
+		return nil, fmt.Errorf("error in selection rules: %w", err)
+	}
+	return &pkg.Arr{
+		Name:            conf.Name,
+		Debrid:          config.Debrid,
+		WatchFolder:     conf.WatchFolder,
+		CompletedFolder: conf.CompletedFolder,
+		Token:           conf.Token,
+		URL:             conf.URL,
+		Client:          client,
+		Selector:        sel,
+		Archives:        conf.Archives,
+	}, nil
+}
+
+// newServices builds the debrid and the arrs from the config
+func newServices(config *common.Config) (debrid.Service, []*pkg.Arr, error) {
+	deb, err := debrid.NewDebrid(config.Debrid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("debrid: %w", err)
+	}
+	arrs := make([]*pkg.Arr, 0, len(config.Arrs))
 	for _, conf := range config.Arrs {
-		wg.Add(1)
-		defer wg.Done()
-		headers := map[string]string{
-			"X-Api-Key": conf.Token,
-		}
-		client := common.NewRLHTTPClient(nil, headers)
-
-		arr := &pkg.Arr{
-			Debrid:          config.Debrid,
-			WatchFolder:     conf.WatchFolder,
-			CompletedFolder: conf.CompletedFolder,
-			Token:           conf.Token,
-			URL:             conf.URL,
-			Client:          client,
+		arr, err := NewArr(config, conf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("arr %s: %w", conf.Name, err)
 		}
-		go StartArr(arr, deb)
+		arrs = append(arrs, arr)
 	}
-	wg.Wait()
+	return deb, arrs, nil
 }
 
 func Start(config *common.Config) {
-	log.Print("[*] BlackHole running")
-	common.InitDB("blackhole.db")
+	slog.Info("BlackHole running")
+	common.InitDB(dbPath)
 	defer common.CloseDB()
-	deb := debrid.NewDebrid(config.Debrid)
-	StartArrs(config, deb)
-
+	if n, err := pkg.FailInterrupted(); err != nil {
+		common.Fatal("Error reading unfinished torrents", "error", err)
+	} else if n > 0 {
+		slog.Warn("Marked torrents interrupted by the last shutdown as failed", "torrents", n)
+	}
+	if err := notify.Setup(config.Notifications); err != nil {
+		common.Fatal("Error setting up notifications", "error", err)
+	}
+	deb, arrs, err := newServices(config)
+	if err != nil {
+		common.Fatal("Error setting up the debrid and arrs", "error", err)
+	}
+	deb.Monitor().Start()
+	jobs := NewJobs(deb, arrs)
+	srv := server.New(config.Server)
+	if config.Server.APIKey == "" {
+		slog.Warn("No server.api_key set, the API is disabled")
+	}
+	srv.AddAccount(deb.Monitor())
+	srv.SetJobs(jobs)
+	registerChecks(srv, config, arrs, deb)
+	srv.Start()
+	d := &daemon{
+		config:   config,
+		deb:      deb,
+		jobs:     jobs,
+		srv:      srv,
+		watchers: make(map[string]*watcher),
+	}
+	deb.SetReauth(d.reauth)
+	for i, arr := range arrs {
+		d.startWatcher(config.Arrs[i], arr)
+	}
+	d.run()
 }
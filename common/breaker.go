@@ -0,0 +1,221 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without sending the request while a host is
+// considered down
+var ErrCircuitOpen = errors.New("circuit open")
+
+const (
+	breakerThreshold   = 5 // failures in a row that open the circuit
+	breakerCooldown    = 30 * time.Second
+	breakerMaxCooldown = 5 * time.Minute
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // requests go through
+	CircuitOpen     CircuitState = "open"      // requests fail right away
+	CircuitHalfOpen CircuitState = "half_open" // one request probes the host
+)
+
+// CircuitStatus is the state of a breaker, for the health endpoints
+type CircuitStatus struct {
+	Host     string       `json:"host"`
+	State    CircuitState `json:"state"`
+	Failures int          `json:"failures"`
+	RetryAt  *time.Time   `json:"retry_at,omitempty"`
+}
+
+// Breaker stops requests to a host after repeated failures. Once the cooldown
+// has passed a single probe request is let through, success closes the
+// circuit and failure opens it again for twice as long.
+type Breaker struct {
+	host     string
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	cooldown time.Duration
+	retryAt  time.Time
+	probing  bool
+	changed  chan struct{} // closed on every state change
+}
+
+var breakers = struct {
+	sync.Mutex
+	byHost map[string]*Breaker
+}{byHost: make(map[string]*Breaker)}
+
+// BreakerFor returns the breaker of a host, shared by every client
+func BreakerFor(host string) *Breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.byHost[host]
+	if !ok {
+		b = &Breaker{host: host, state: CircuitClosed, cooldown: breakerCooldown, changed: make(chan struct{})}
+		breakers.byHost[host] = b
+	}
+	return b
+}
+
+// Circuits returns the state of every host requests were sent to
+func Circuits() []CircuitStatus {
+	breakers.Lock()
+	list := make([]*Breaker, 0, len(breakers.byHost))
+	for _, b := range breakers.byHost {
+		list = append(list, b)
+	}
+	breakers.Unlock()
+	statuses := make([]CircuitStatus, 0, len(list))
+	for _, b := range list {
+		statuses = append(statuses, b.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+// Host returns the host the breaker guards
+func (b *Breaker) Host() string {
+	return b.host
+}
+
+// Status returns the state of the breaker for reporting
+func (b *Breaker) Status() CircuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := CircuitStatus{Host: b.host, State: b.state, Failures: b.failures}
+	if b.state == CircuitOpen && !time.Now().Before(b.retryAt) {
+		// The next request probes the host
+		status.State = CircuitHalfOpen
+	}
+	if b.state != CircuitClosed {
+		retryAt := b.retryAt
+		status.RetryAt = &retryAt
+	}
+	return status
+}
+
+// State returns the state of the circuit
+func (b *Breaker) State() CircuitState {
+	return b.Status().State
+}
+
+// allow reports whether a request can be sent. probe is true for the request
+// that tests a half open circuit, its outcome has to be passed to done.
+func (b *Breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && !time.Now().Before(b.retryAt) {
+		b.setState(CircuitHalfOpen)
+	}
+	switch b.state {
+	case CircuitClosed:
+		return false, nil
+	case CircuitHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("%w: %s is unreachable, retrying at %s", ErrCircuitOpen, b.host, b.retryAt.Format(time.TimeOnly))
+}
+
+// outcome is what a request says about the health of its host
+type outcome int
+
+const (
+	outcomeUnknown outcome = iota // cancelled by the caller
+	outcomeSuccess
+	outcomeFailure
+)
+
+// done records the outcome of a request
+func (b *Breaker) done(probe bool, result outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	failed := result == outcomeFailure
+	switch {
+	case result == outcomeUnknown:
+		if probe {
+			// Let another request probe the host
+			close(b.changed)
+			b.changed = make(chan struct{})
+		}
+	case b.state == CircuitClosed && failed:
+		b.failures++
+		if b.failures >= breakerThreshold {
+			b.open()
+		}
+	case b.state == CircuitClosed:
+		b.failures = 0
+	case b.state == CircuitHalfOpen && probe && failed:
+		b.cooldown = min(b.cooldown*2, breakerMaxCooldown)
+		b.open()
+	case b.state == CircuitHalfOpen && probe:
+		slog.Info("Host is reachable again, closing circuit", "host", b.host)
+		b.failures = 0
+		b.cooldown = breakerCooldown
+		b.setState(CircuitClosed)
+	}
+}
+
+func (b *Breaker) open() {
+	b.retryAt = time.Now().Add(b.cooldown)
+	slog.Warn("Host is failing, opening circuit", "host", b.host, "failures", b.failures, "retry_at", b.retryAt)
+	b.setState(CircuitOpen)
+}
+
+func (b *Breaker) setState(state CircuitState) {
+	b.state = state
+	CircuitStates.WithLabelValues(b.host).Set(circuitStateValue[state])
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+var circuitStateValue = map[CircuitState]float64{
+	CircuitClosed:   0,
+	CircuitHalfOpen: 1,
+	CircuitOpen:     2,
+}
+
+// Wait blocks until requests to the host can be tried again or the context
+// is done
+func (b *Breaker) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		state, retryAt, probing, changed := b.state, b.retryAt, b.probing, b.changed
+		b.mu.Unlock()
+		if state == CircuitClosed || (state == CircuitHalfOpen && !probing) {
+			return nil
+		}
+		wait := time.Until(retryAt)
+		if state == CircuitOpen && wait <= 0 {
+			return nil
+		}
+		if state == CircuitHalfOpen {
+			// Another request is probing, its outcome changes the state
+			wait = time.Hour
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
@@ -1,49 +1,109 @@
 package common
 
 import (
-	"encoding/json"
-	"log"
 	"os"
+	"path/filepath"
 )
 
 type DebridConfig struct {
-	Name             string `json:"name"`
-	Host             string `json:"host"`
-	APIKey           string `json:"api_key"`
-	Folder           string `json:"folder"`
-	DownloadUncached bool   `json:"download_uncached"`
-	RateLimit        string `json:"rate_limit"` // 200/minute or 10/second
+	Name             string     `json:"name"`
+	Host             string     `json:"host"`
+	APIKey           string     `json:"api_key"`
+	Folder           string     `json:"folder"`
+	DownloadUncached bool       `json:"download_uncached"`
+	RateLimit        string     `json:"rate_limit"`        // 200/minute or 10/second
+	MaxUncached      int        `json:"max_uncached"`      // uncached torrents downloading at once, 0 for no limit
+	MaxUncachedWait  string     `json:"max_uncached_wait"` // 24h, 90m
+	MaxSlotWait      string     `json:"max_slot_wait"`     // how long a job waits for a free torrent slot, 2h
+	MinSeeders       int        `json:"min_seeders"`
+	AvailabilityTTL  string     `json:"availability_ttl"`    // how long instant availability results are cached
+	AccountInterval  string     `json:"account_interval"`    // how often the account is checked, 1h
+	ExpiryWarning    int        `json:"expiry_warning_days"` // warn when fewer premium days are left, 7
+	HTTP             HTTPConfig `json:"http"`
+}
+
+// SelectionConfig decides which files of a torrent are downloaded
+type SelectionConfig struct {
+	Preset       string   `json:"preset"`        // video, audio, books or all
+	Include      []string `json:"include"`       // globs, matched on the file name or on the path if they contain a /
+	Exclude      []string `json:"exclude"`       // globs
+	IncludeRegex []string `json:"include_regex"` // regexes, matched on the path
+	ExcludeRegex []string `json:"exclude_regex"` // regexes
+	MinSize      string   `json:"min_size"`      // 50MB, 1.5GiB
+	MaxSize      string   `json:"max_size"`
+	SkipSamples  *bool    `json:"skip_samples"` // defaults to true
+	LargestOnly  bool     `json:"largest_only"`
+}
+
+type ArrConfig struct {
+	Name            string          `json:"name"` // used in logs and metrics, defaults to the watch folder name
+	WatchFolder     string          `json:"watch_folder"`
+	CompletedFolder string          `json:"completed_folder"`
+	Token           string          `json:"token"`
+	URL             string          `json:"url"`
+	Selection       SelectionConfig `json:"selection"`
+	Archives        string          `json:"archives"` // extract or fail, for torrents that only contain archives
+	HTTP            HTTPConfig      `json:"http"`
+}
+
+type ServerConfig struct {
+	Address string `json:"address"` // :8181
+	APIKey  string `json:"api_key"` // required by /api, the API is off without one
+}
+
+type NotificationConfig struct {
+	Type     string     `json:"type"`     // webhook, discord, ntfy or gotify
+	URL      string     `json:"url"`      // for ntfy the topic url, https://ntfy.sh/my-topic
+	Token    string     `json:"token"`    // gotify app token or ntfy access token
+	Events   []string   `json:"events"`   // submitted, cached_miss, downloaded, linked, failed, account_expiring. Empty for all
+	Template string     `json:"template"` // text/template for the message, executed with the event
+	Retries  int        `json:"retries"`
+	HTTP     HTTPConfig `json:"http"`
 }
 
 type Config struct {
-	Debrid DebridConfig `json:"debrid"`
-	Arrs   []struct {
-		WatchFolder     string `json:"watch_folder"`
-		CompletedFolder string `json:"completed_folder"`
-		Token           string `json:"token"`
-		URL             string `json:"url"`
-	} `json:"arrs"`
+	Debrid        DebridConfig         `json:"debrid"`
+	Arrs          []ArrConfig          `json:"arrs"`
+	Server        ServerConfig         `json:"server"`
+	Notifications []NotificationConfig `json:"notifications"`
+	LogLevel      string               `json:"log_level"`  // debug, info, warn or error
+	LogFormat     string               `json:"log_format"` // text or json
+
+	Path string `json:"-"` // file the config was loaded from, watched for changes
 }
 
-func LoadConfig(path string) (*Config, error) {
-	// Load the config file
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+func (c *Config) applyDefaults() {
+	if c.Debrid.Name == "" {
+		c.Debrid.Name = "realdebrid"
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			log.Fatal(err)
+	for i := range c.Arrs {
+		if c.Arrs[i].Name == "" {
+			c.Arrs[i].Name = filepath.Base(c.Arrs[i].WatchFolder)
 		}
-	}(file)
+	}
+	if c.Server.Address == "" {
+		c.Server.Address = ":8181"
+	}
+}
 
-	decoder := json.NewDecoder(file)
-	config := &Config{}
-	err = decoder.Decode(config)
+// LoadConfig reads a JSON, YAML or TOML config, picked by the file extension,
+// applies the BLACKHOLE_ environment variables and validates the result.
+// Folders aren't looked at, see CheckFolders.
+func LoadConfig(path string) (*Config, error) {
+	environ := os.Environ()
+	data, err := readConfigFile(path, environ)
 	if err != nil {
 		return nil, err
 	}
-
+	config := &Config{Path: path}
+	problems := &ConfigError{}
+	if err := decodeConfig(data, environ, config, problems); err != nil {
+		return nil, err
+	}
+	config.applyDefaults()
+	config.validate(problems)
+	if err := problems.orNil(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
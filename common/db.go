@@ -2,7 +2,9 @@ package common
 
 import (
 	"database/sql"
-	"log"
+	"fmt"
+	"log/slog"
+	"strings"
 	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -17,18 +19,24 @@ var (
 func InitDB(dataSourceName string) {
 	once.Do(func() {
 		var err error
-		database, err = sql.Open("sqlite3", dataSourceName)
+		database, err = sql.Open("sqlite3", withPragmas(dataSourceName))
 		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = database.Exec("PRAGMA foreign_keys = ON")
-		if err != nil {
-			log.Fatalf("Error enabling foreign keys: %v", err)
+			Fatal("Error opening database", "error", err)
 		}
 		createTables()
 	})
 }
 
+// withPragmas turns on foreign keys and a busy timeout in the DSN, a PRAGMA
+// run once would only apply to one connection of the pool
+func withPragmas(dataSourceName string) string {
+	sep := "?"
+	if strings.Contains(dataSourceName, "?") {
+		sep = "&"
+	}
+	return dataSourceName + sep + "_foreign_keys=on&_busy_timeout=5000"
+}
+
 func GetDB() *sql.DB {
 	return database
 }
@@ -55,26 +63,139 @@ func createTables() {
 		magnet TEXT,
 		status TEXT,
 		error TEXT,
-	    watch_folder TEXT
+	    watch_folder TEXT,
+		progress REAL DEFAULT 0,
+		speed INTEGER DEFAULT 0,
+		seeders INTEGER DEFAULT 0,
+		debrid_id TEXT,
+		arr TEXT,
+		created_at INTEGER,
+		updated_at INTEGER
 	);`
 
+	// File ids come from the debrid and are only unique within a torrent
 	createFileTable := `
 	CREATE TABLE IF NOT EXISTS file (
-		id TEXT PRIMARY KEY,
+		id TEXT,
 		name TEXT,
 		size INTEGER,
 		path TEXT,
 		torrent_id TEXT,
-		FOREIGN KEY(torrent_id) REFERENCES torrent(id)
+		PRIMARY KEY(torrent_id, id),
+		FOREIGN KEY(torrent_id) REFERENCES torrent(id) ON DELETE CASCADE
+	);`
+
+	createAvailabilityTable := `
+	CREATE TABLE IF NOT EXISTS availability (
+		info_hash TEXT PRIMARY KEY,
+		cached INTEGER,
+		hosters TEXT,
+		checked_at INTEGER
+	);`
+
+	createAccountTable := `
+	CREATE TABLE IF NOT EXISTS account (
+		debrid TEXT PRIMARY KEY,
+		username TEXT,
+		premium INTEGER,
+		expiration INTEGER,
+		points INTEGER,
+		traffic INTEGER,
+		checked_at INTEGER
+	);`
+
+	createHistoryTable := `
+	CREATE TABLE IF NOT EXISTS torrent_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		torrent_id TEXT,
+		status TEXT,
+		error TEXT,
+		created_at INTEGER,
+		FOREIGN KEY(torrent_id) REFERENCES torrent(id) ON DELETE CASCADE
 	);`
 
 	_, err := database.Exec(createTorrentTable)
 	if err != nil {
-		log.Fatalf("Error creating torrent table: %v", err)
+		Fatal("Error creating torrent table", "error", err)
 	}
 
+	migrateFileTable()
 	_, err = database.Exec(createFileTable)
 	if err != nil {
-		log.Fatalf("Error creating file table: %v", err)
+		Fatal("Error creating file table", "error", err)
+	}
+
+	_, err = database.Exec(createAvailabilityTable)
+	if err != nil {
+		Fatal("Error creating availability table", "error", err)
+	}
+
+	_, err = database.Exec(createAccountTable)
+	if err != nil {
+		Fatal("Error creating account table", "error", err)
+	}
+
+	_, err = database.Exec(createHistoryTable)
+	if err != nil {
+		Fatal("Error creating torrent history table", "error", err)
+	}
+
+	// Columns added after the initial schema
+	addColumn("torrent", "progress", "REAL DEFAULT 0")
+	addColumn("torrent", "speed", "INTEGER DEFAULT 0")
+	addColumn("torrent", "seeders", "INTEGER DEFAULT 0")
+	addColumn("torrent", "debrid_id", "TEXT")
+	addColumn("torrent", "arr", "TEXT")
+	addColumn("torrent", "created_at", "INTEGER")
+	addColumn("torrent", "updated_at", "INTEGER")
+}
+
+// migrateFileTable drops the file table if it still uses the debrid file id as
+// its primary key. File lists are re-read from the debrid for every job.
+func migrateFileTable() {
+	columns := tableColumns("file")
+	if pk, ok := columns["torrent_id"]; !ok || pk > 0 {
+		return
+	}
+	slog.Info("Recreating file table with a per-torrent primary key")
+	if _, err := database.Exec("DROP TABLE file"); err != nil {
+		Fatal("Error dropping file table", "error", err)
+	}
+}
+
+// addColumn adds a column to an existing table if it is missing
+func addColumn(table, column, definition string) {
+	if _, ok := tableColumns(table)[column]; ok {
+		return
+	}
+	_, err := database.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		Fatal("Error adding column", "table", table, "column", column, "error", err)
+	}
+}
+
+// tableColumns returns the columns of a table with their position in the
+// primary key, 0 if they aren't part of it
+func tableColumns(table string) map[string]int {
+	rows, err := database.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		Fatal("Error reading table", "table", table, "error", err)
+	}
+	defer rows.Close()
+	columns := make(map[string]int)
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			Fatal("Error reading table", "table", table, "error", err)
+		}
+		columns[name] = pk
 	}
+	return columns
 }
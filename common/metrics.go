@@ -0,0 +1,82 @@
+package common
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	TorrentsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blackhole_torrents_processed_total",
+		Help: "Torrents that were downloaded and handed to the arr",
+	}, []string{"arr", "debrid"})
+
+	TorrentsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blackhole_torrents_failed_total",
+		Help: "Torrents that failed at any stage",
+	}, []string{"arr", "debrid"})
+
+	TorrentsCached = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blackhole_torrents_cached_total",
+		Help: "Torrents that were already cached on the debrid",
+	}, []string{"arr", "debrid"})
+
+	TorrentsUncached = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blackhole_torrents_uncached_total",
+		Help: "Torrents that were not cached on the debrid",
+	}, []string{"arr", "debrid"})
+
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blackhole_stage_duration_seconds",
+		Help:    "Time spent in each stage of a torrent's lifecycle",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+	}, []string{"stage", "arr", "debrid"})
+
+	MountWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blackhole_mount_wait_seconds",
+		Help:    "Time files took to show up on the debrid mount",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"arr"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blackhole_http_request_duration_seconds",
+		Help:    "Latency of requests to the debrid and arr APIs",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "method", "code"})
+
+	HTTPRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blackhole_http_retries_total",
+		Help: "Requests to the debrid and arr APIs that were sent again, by reason",
+	}, []string{"host", "reason"})
+
+	CircuitStates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blackhole_circuit_state",
+		Help: "Circuit breaker of each host, 0 closed, 1 half open, 2 open",
+	}, []string{"host"})
+
+	RateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blackhole_rate_limit_wait_seconds",
+		Help:    "Time requests waited on the rate limiter",
+		Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 15, 60},
+	}, []string{"host"})
+
+	DebridPremium = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blackhole_debrid_premium_seconds",
+		Help: "Premium time left on the debrid account",
+	}, []string{"debrid"})
+
+	DebridPoints = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blackhole_debrid_points",
+		Help: "Fidelity points on the debrid account",
+	}, []string{"debrid"})
+
+	DebridTraffic = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blackhole_debrid_traffic_bytes",
+		Help: "Traffic used on the debrid account today",
+	}, []string{"debrid"})
+
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blackhole_queue_depth",
+		Help: "Items waiting in each queue",
+	}, []string{"queue"})
+)
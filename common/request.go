@@ -1,130 +1,283 @@
 package common
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"golang.org/x/time/rate"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type RLHTTPClient struct {
-	client      *http.Client
-	Ratelimiter *rate.Limiter
-	Headers     map[string]string
+	client *http.Client
+
+	// The limiter and headers can be swapped while requests are running
+	mu          sync.RWMutex
+	ratelimiter *rate.Limiter
+	headers     map[string]string
+	retry       RetryPolicy
+}
+
+// SetRateLimiter replaces the rate limiter, nil for no limit. Requests already
+// waiting keep waiting on the old one.
+func (c *RLHTTPClient) SetRateLimiter(rl *rate.Limiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ratelimiter = rl
+}
+
+// SetHeaders replaces the headers sent with every request, such as credentials
+func (c *RLHTTPClient) SetHeaders(headers map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = headers
+}
+
+// Header returns a header sent with every request
+func (c *RLHTTPClient) Header(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.headers[key]
 }
 
+// SetRetryPolicy replaces the retry policy, DefaultRetryPolicy until set
+func (c *RLHTTPClient) SetRetryPolicy(policy RetryPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retry = policy
+}
+
+// ApplyHeaders sets the headers of the client on a request
+func (c *RLHTTPClient) ApplyHeaders(req *http.Request) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+}
+
+// Doer sends a request once, without retries
 func (c *RLHTTPClient) Doer(req *http.Request) (*http.Response, error) {
-	if c.Ratelimiter != nil {
-		err := c.Ratelimiter.Wait(req.Context())
+	breaker := BreakerFor(req.URL.Host)
+	probe, err := breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	resp, result, err := c.send(req)
+	breaker.done(probe, result)
+	return resp, err
+}
+
+// send sends a request once the rate limiter lets it through, and tells what
+// its outcome says about the host. The breaker is left to the caller.
+func (c *RLHTTPClient) send(req *http.Request) (*http.Response, outcome, error) {
+	host := req.URL.Host
+	c.mu.RLock()
+	ratelimiter := c.ratelimiter
+	c.mu.RUnlock()
+	if ratelimiter != nil {
+		start := time.Now()
+		err := ratelimiter.Wait(req.Context())
+		RateLimitWait.WithLabelValues(host).Observe(time.Since(start).Seconds())
 		if err != nil {
-			return nil, err
+			return nil, outcomeUnknown, err
 		}
 	}
+	slog.Debug("HTTP request", "method", req.Method, "url", req.URL.String(), "headers", RedactHeaders(req.Header))
+	start := time.Now()
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, err
+		result := outcomeFailure
+		if req.Context().Err() != nil {
+			result = outcomeUnknown
+		}
+		HTTPRequestDuration.WithLabelValues(host, req.Method, "error").Observe(time.Since(start).Seconds())
+		slog.Debug("HTTP request failed", "method", req.Method, "url", req.URL.String(), "error", err)
+		return nil, result, err
 	}
-	return resp, nil
+	result := outcomeSuccess
+	if resp.StatusCode >= 500 {
+		result = outcomeFailure
+	}
+	HTTPRequestDuration.WithLabelValues(host, req.Method, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+	slog.Debug("HTTP response", "method", req.Method, "url", req.URL.String(), "status", resp.StatusCode, "duration", time.Since(start))
+	return resp, result, nil
 }
 
+// Do sends a request, retrying it as the retry policy of the client allows.
+// The response of the last attempt is returned whatever its status. The
+// breaker of the host counts the outcome of the last attempt only, a request
+// retried on 503s is one failure and not one per attempt.
 func (c *RLHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	var resp *http.Response
-	var err error
-	backoff := time.Millisecond * 500
+	c.mu.RLock()
+	policy := c.retry
+	c.mu.RUnlock()
+	if err := replayableBody(req); err != nil {
+		return nil, err
+	}
+	breaker := BreakerFor(req.URL.Host)
+	probe, err := breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	result := outcomeUnknown
+	defer func() { breaker.done(probe, result) }()
 
-	for i := 0; i < 3; i++ {
-		resp, err = c.Doer(req)
-		if err != nil {
-			return nil, err
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, result, err = c.send(req)
+		reason, retry := policy.shouldRetry(req, resp, err)
+		if !retry || attempt >= policy.MaxAttempts {
+			return resp, err
 		}
-
-		if resp.StatusCode != http.StatusTooManyRequests {
-			return resp, nil
+		wait := policy.backoff(attempt)
+		if after, ok := retryAfter(resp, time.Now()); ok {
+			wait = after
+		}
+		if policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			return resp, err
+		}
+		if resp != nil {
+			// Drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			_ = resp.Body.Close()
+		}
+		HTTPRetries.WithLabelValues(req.URL.Host, reason).Inc()
+		slog.Debug("Retrying HTTP request", "method", req.Method, "url", req.URL.String(), "reason", reason, "attempt", attempt, "wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
 		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
 
-		// Close the response body to prevent resource leakage
-		resp.Body.Close()
+// maxErrorBody is how much of an error response is kept
+const maxErrorBody = 64 << 10
 
-		// Wait for the backoff duration before retrying
-		time.Sleep(backoff)
+// HTTPError is a response outside the 2xx range. Services that describe their
+// errors in the body parse it into their own error types.
+type HTTPError struct {
+	StatusCode int
+	Body       []byte
+}
 
-		// Exponential backoff
-		backoff *= 2
+func (e *HTTPError) Error() string {
+	body := strings.TrimSpace(string(e.Body))
+	if body == "" {
+		return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
 	}
-
-	return resp, fmt.Errorf("max retries exceeded")
+	if len(body) > 200 {
+		body = body[:200] + "..."
+	}
+	return fmt.Sprintf("unexpected status code: %d: %s", e.StatusCode, body)
 }
 
 func (c *RLHTTPClient) MakeRequest(method string, url string, body io.Reader) ([]byte, error) {
-	req, err := http.NewRequest(method, url, body)
+	return c.MakeRequestContext(context.Background(), method, url, body)
+}
+
+// MakeRequestContext is MakeRequest bound to a context, which cancels the
+// request and any wait for a retry
+func (c *RLHTTPClient) MakeRequestContext(ctx context.Context, method string, url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
-	if c.Headers != nil {
-		for key, value := range c.Headers {
-			req.Header.Set(key, value)
-		}
-	}
+	c.ApplyHeaders(req)
 
 	res, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	statusOk := strconv.Itoa(res.StatusCode)[0] == '2'
-	if !statusOk {
-		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
-	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			log.Println(err)
+			slog.Warn("Error closing response body", "error", err)
 		}
 	}(res.Body)
+	statusOk := strconv.Itoa(res.StatusCode)[0] == '2'
+	if !statusOk {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+		return nil, &HTTPError{StatusCode: res.StatusCode, Body: body}
+	}
 	return io.ReadAll(res.Body)
 }
 
-func NewRLHTTPClient(rl *rate.Limiter, headers map[string]string) *RLHTTPClient {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// ClientOption changes an RLHTTPClient as it is built
+type ClientOption func(*RLHTTPClient)
+
+// WithTransport sends the requests of a client through a transport built by
+// NewTransport, for a proxy or custom certificates
+func WithTransport(tr http.RoundTripper) ClientOption {
+	return func(c *RLHTTPClient) {
+		c.client.Transport = tr
 	}
+}
+
+// NewRLHTTPClient returns a client that verifies certificates and connects
+// directly, unless an option says otherwise
+func NewRLHTTPClient(rl *rate.Limiter, headers map[string]string, opts ...ClientOption) *RLHTTPClient {
+	tr, _ := NewTransport(HTTPConfig{}) // the zero config can't fail
 	c := &RLHTTPClient{
 		client: &http.Client{
 			Transport: tr,
 		},
-		Ratelimiter: rl,
-		Headers:     headers,
+		ratelimiter: rl,
+		headers:     headers,
+		retry:       DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 	return c
 }
 
-func ParseRateLimit(rateStr string) *rate.Limiter {
+var rateLimitPattern = regexp.MustCompile(`^(\d+)/(minute|second)$`)
+
+// CheckRateLimit reports whether a rate limit can be parsed, empty means none
+func CheckRateLimit(rateStr string) error {
 	if rateStr == "" {
 		return nil
 	}
-	re := regexp.MustCompile(`(\d+)/(minute|second)`)
-	matches := re.FindStringSubmatch(rateStr)
-	if len(matches) != 3 {
-		return nil
+	matches := rateLimitPattern.FindStringSubmatch(strings.TrimSpace(rateStr))
+	if matches == nil {
+		return fmt.Errorf("must look like 200/minute or 10/second, not %q", rateStr)
 	}
+	if count, err := strconv.Atoi(matches[1]); err != nil || count == 0 {
+		return fmt.Errorf("must allow at least one request, not %q", rateStr)
+	}
+	return nil
+}
 
-	count, err := strconv.Atoi(matches[1])
-	if err != nil {
+// ParseRateLimit returns the limiter for a rate limit, nil for none. Limits
+// are checked by CheckRateLimit when the config is loaded.
+func ParseRateLimit(rateStr string) *rate.Limiter {
+	if CheckRateLimit(rateStr) != nil || rateStr == "" {
 		return nil
 	}
+	matches := rateLimitPattern.FindStringSubmatch(strings.TrimSpace(rateStr))
+	count, _ := strconv.Atoi(matches[1])
 
-	unit := matches[2]
-	switch unit {
+	switch matches[2] {
 	case "minute":
 		reqsPerSecond := float64(count) / 60.0
 		return rate.NewLimiter(rate.Limit(reqsPerSecond), 5)
-	case "second":
-		return rate.NewLimiter(rate.Limit(float64(count)), 5)
 	default:
-		return nil
+		return rate.NewLimiter(rate.Limit(float64(count)), 5)
 	}
 }
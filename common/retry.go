@@ -0,0 +1,126 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides when RLHTTPClient sends a request again. Rate limited
+// requests are always retried, server errors and dropped connections only for
+// idempotent requests since the server may have acted on them.
+type RetryPolicy struct {
+	MaxAttempts int           // including the first, 1 turns retries off
+	BaseDelay   time.Duration // wait before the first retry, doubled after each one
+	MaxDelay    time.Duration // longest wait between attempts, unless Retry-After asks for more
+	MaxElapsed  time.Duration // no retry is started past this, 0 for no limit
+}
+
+// DefaultRetryPolicy is used by clients that don't set one
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	MaxElapsed:  2 * time.Minute,
+}
+
+// retryStatuses are the server errors worth another try
+var retryStatuses = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// shouldRetry returns why a request should be sent again, used as a metric label
+func (p RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error) (string, bool) {
+	if err != nil {
+		if req.Context().Err() == nil && isIdempotent(req) && isConnectionReset(err) {
+			return "connection", true
+		}
+		return "", false
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "rate_limited", true
+	}
+	if retryStatuses[resp.StatusCode] && isIdempotent(req) {
+		return strconv.Itoa(resp.StatusCode), true
+	}
+	return "", false
+}
+
+// backoff returns the wait before a retry, between half and all of the
+// exponential delay so clients don't retry in step
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// isIdempotent reports whether a request can be sent twice. PUT isn't, APIs
+// like PUT /torrents/addTorrent create something on every call. A request
+// with an Idempotency-Key header can be sent twice like a GET.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodDelete:
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+func isConnectionReset(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryAfter reads the Retry-After header, in seconds or as an HTTP date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// replayableBody makes sure the body of a request can be read again for a
+// retry. Bodies from http.NewRequest can already, others are buffered.
+func replayableBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+	data, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the environment variables that override config settings,
+// BLACKHOLE_DEBRID_API_KEY sets debrid.api_key and BLACKHOLE_ARRS_0_TOKEN
+// sets arrs[0].token. A _FILE suffix reads the value from a file.
+const EnvPrefix = "BLACKHOLE_"
+
+// readConfigFile returns the config as JSON whatever format it is written in.
+// A missing file is an empty config if the environment sets the settings.
+func readConfigFile(path string, environ []string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && hasEnvOverrides(environ) {
+		return []byte("{}"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return []byte("{}"), nil
+	}
+	data, err = json.Marshal(tree)
+	if err != nil {
+		return nil, fmt.Errorf("config can't be represented as JSON: %w", err)
+	}
+	return data, nil
+}
+
+func hasEnvOverrides(environ []string) bool {
+	for _, env := range environ {
+		if strings.HasPrefix(env, EnvPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyEnv sets the settings named by BLACKHOLE_ variables in the decoded
+// config. Unknown variables are reported as problems.
+func applyEnv(tree map[string]any, environ []string, problems *ConfigError) {
+	sort.Strings(environ)
+	for _, env := range environ {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		tokens := strings.Split(strings.TrimPrefix(name, EnvPrefix), "_")
+		path, leaf, ok := envPath(reflect.TypeOf(Config{}), tokens)
+		if !ok && len(tokens) > 1 && tokens[len(tokens)-1] == "FILE" {
+			if path, leaf, ok = envPath(reflect.TypeOf(Config{}), tokens[:len(tokens)-1]); ok {
+				if _, set := os.LookupEnv(strings.TrimSuffix(name, "_FILE")); set {
+					problems.add(name, "can't be set together with %s", strings.TrimSuffix(name, "_FILE"))
+					continue
+				}
+				secret, err := os.ReadFile(value)
+				if err != nil {
+					problems.add(name, "%v", err)
+					continue
+				}
+				value = strings.TrimRight(string(secret), "\r\n")
+			}
+		}
+		if !ok {
+			problems.add(name, "does not match any setting")
+			continue
+		}
+		setPath(tree, path, envValue(leaf, value))
+	}
+}
+
+// envPath matches the tokens of a variable name with the JSON names of the
+// config fields. Names contain underscores themselves, so every way of
+// grouping the tokens is tried.
+func envPath(t reflect.Type, tokens []string) ([]any, reflect.Type, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if len(tokens) == 0 {
+		return nil, t, true
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			nameTokens := strings.Split(strings.ToUpper(name), "_")
+			if len(nameTokens) > len(tokens) || !equalTokens(nameTokens, tokens[:len(nameTokens)]) {
+				continue
+			}
+			if rest, leaf, ok := envPath(field.Type, tokens[len(nameTokens):]); ok {
+				return append([]any{name}, rest...), leaf, true
+			}
+		}
+	case reflect.Slice:
+		index, err := strconv.Atoi(tokens[0])
+		if err != nil || index < 0 {
+			return nil, nil, false
+		}
+		if rest, leaf, ok := envPath(t.Elem(), tokens[1:]); ok {
+			return append([]any{index}, rest...), leaf, true
+		}
+	}
+	return nil, nil, false
+}
+
+func equalTokens(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// envValue converts a variable to the type of the setting. Values that don't
+// convert are kept as strings and reported when the config is decoded.
+func envValue(t reflect.Type, value string) any {
+	switch t.Kind() {
+	case reflect.String:
+		return value
+	case reflect.Slice:
+		var list []any
+		if json.Unmarshal([]byte(value), &list) == nil {
+			return list
+		}
+		for _, item := range strings.Split(value, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+		return list
+	default:
+		var v any
+		if json.Unmarshal([]byte(value), &v) == nil {
+			return v
+		}
+		return value
+	}
+}
+
+// setPath sets a value in a decoded JSON tree, creating objects and growing
+// lists on the way
+func setPath(tree map[string]any, path []any, value any) {
+	var node any = tree
+	set := func(v any) {}
+	for i, key := range path {
+		last := i == len(path)-1
+		switch k := key.(type) {
+		case string:
+			object, ok := node.(map[string]any)
+			if !ok {
+				object = map[string]any{}
+				set(object)
+			}
+			if last {
+				object[k] = value
+				return
+			}
+			node = object[k]
+			set = func(v any) { object[k] = v }
+		case int:
+			list, _ := node.([]any)
+			for len(list) <= k {
+				list = append(list, map[string]any{})
+			}
+			set(list)
+			if last {
+				list[k] = value
+				return
+			}
+			node = list[k]
+			set = func(v any) { list[k] = v }
+		}
+	}
+}
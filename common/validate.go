@@ -0,0 +1,385 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	gourl "net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigProblem is something wrong with one setting
+type ConfigProblem struct {
+	Path    string // JSON path of the setting, arrs[0].watch_folder
+	Message string
+}
+
+// ConfigError lists every problem found in a config
+type ConfigError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d problem(s) in config:", len(e.Problems))
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n  %s: %s", p.Path, p.Message)
+	}
+	return b.String()
+}
+
+// add records a problem, unless the setting already has one. Decoding runs
+// first, so a setting of the wrong type isn't also reported as missing.
+func (e *ConfigError) add(path, format string, args ...any) {
+	for _, p := range e.Problems {
+		if p.Path == path {
+			return
+		}
+	}
+	e.Problems = append(e.Problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ConfigError) orNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// decodeConfig decodes a config with the environment overrides applied, and
+// adds every unknown field to the problems where
+// json.Decoder.DisallowUnknownFields would stop at the first. Only syntax
+// errors are returned.
+func decodeConfig(data []byte, environ []string, config *Config, problems *ConfigError) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			line, col := position(data, syntax.Offset)
+			return fmt.Errorf("line %d, column %d: %w", line, col, err)
+		}
+		return err
+	}
+	if tree, ok := raw.(map[string]any); ok && hasEnvOverrides(environ) {
+		applyEnv(tree, environ, problems)
+		var err error
+		if data, err = json.Marshal(tree); err != nil {
+			return err
+		}
+	}
+	unknownFields(raw, reflect.TypeOf(config).Elem(), "", problems)
+
+	if err := json.Unmarshal(data, config); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return err
+		}
+		problems.add(jsonPath(typeErr.Field), "must be a %s, not a %s", typeName(typeErr.Type), typeErr.Value)
+	}
+	return nil
+}
+
+// position turns a byte offset into a line and column, both starting at 1
+func position(data []byte, offset int64) (int, int) {
+	before := data[:min(int(offset), len(data))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// jsonPath turns the dotted field path of encoding/json into arrs[0].token
+func jsonPath(field string) string {
+	parts := strings.Split(field, ".")
+	var b strings.Builder
+	for i, part := range parts {
+		if part != "" && strings.Trim(part, "0123456789") == "" {
+			fmt.Fprintf(&b, "[%s]", part)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Slice:
+		return "list"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "number"
+	}
+	return t.Kind().String()
+}
+
+func unknownFields(value any, t reflect.Type, path string, problems *ConfigError) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			field, ok := fieldByTag(t, key)
+			if !ok {
+				problems.add(fieldPath, "unknown field")
+				continue
+			}
+			unknownFields(object[key], field.Type, fieldPath, problems)
+		}
+	case reflect.Slice:
+		list, ok := value.([]any)
+		if !ok {
+			return
+		}
+		for i, item := range list {
+			unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	}
+}
+
+// fieldByTag finds a field by its JSON name, ignoring case like encoding/json
+func fieldByTag(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Validate checks every setting and reports all problems at once. The
+// folders are only checked by CheckFolders.
+func (c *Config) Validate() error {
+	problems := &ConfigError{}
+	c.validate(problems)
+	return problems.orNil()
+}
+
+// CheckFolders makes sure the folders of a valid config exist and the watch
+// and completed folders are writable. The daemon needs them, the commands
+// that only read the database don't.
+func (c *Config) CheckFolders() error {
+	problems := &ConfigError{}
+	checkFolder(problems, "debrid.folder", c.Debrid.Folder, false)
+	for i, arr := range c.Arrs {
+		path := fmt.Sprintf("arrs[%d]", i)
+		checkFolder(problems, path+".watch_folder", arr.WatchFolder, true)
+		checkFolder(problems, path+".completed_folder", arr.CompletedFolder, true)
+	}
+	return problems.orNil()
+}
+
+func (c *Config) validate(problems *ConfigError) {
+	d := c.Debrid
+	if d.Name != "realdebrid" {
+		problems.add("debrid.name", "unknown debrid %q, supported: realdebrid", d.Name)
+	}
+	checkURL(problems, "debrid.host", d.Host)
+	if d.APIKey == "" {
+		problems.add("debrid.api_key", "is required")
+	}
+	checkRequired(problems, "debrid.folder", d.Folder)
+	if err := CheckRateLimit(d.RateLimit); err != nil {
+		problems.add("debrid.rate_limit", "%v", err)
+	}
+	checkDuration(problems, "debrid.max_uncached_wait", d.MaxUncachedWait)
+	checkDuration(problems, "debrid.max_slot_wait", d.MaxSlotWait)
+	checkDuration(problems, "debrid.availability_ttl", d.AvailabilityTTL)
+	checkDuration(problems, "debrid.account_interval", d.AccountInterval)
+	checkNotNegative(problems, "debrid.max_uncached", d.MaxUncached)
+	checkNotNegative(problems, "debrid.min_seeders", d.MinSeeders)
+	checkNotNegative(problems, "debrid.expiry_warning_days", d.ExpiryWarning)
+	checkHTTP(problems, "debrid.http", d.HTTP)
+
+	if len(c.Arrs) == 0 {
+		problems.add("arrs", "at least one arr is required")
+	}
+	watchFolders := make(map[string]string)
+	names := make(map[string]string)
+	for i, arr := range c.Arrs {
+		path := fmt.Sprintf("arrs[%d]", i)
+		if checkRequired(problems, path+".watch_folder", arr.WatchFolder) {
+			folder, _ := filepath.Abs(arr.WatchFolder)
+			if other, ok := watchFolders[folder]; ok {
+				problems.add(path+".watch_folder", "%s is also the watch folder of %s", arr.WatchFolder, other)
+			} else {
+				watchFolders[folder] = path
+			}
+		}
+		checkRequired(problems, path+".completed_folder", arr.CompletedFolder)
+		checkURL(problems, path+".url", arr.URL)
+		if arr.Token == "" {
+			problems.add(path+".token", "is required")
+		}
+		if other, ok := names[arr.Name]; ok && arr.Name != "" {
+			problems.add(path+".name", "%q is also the name of %s", arr.Name, other)
+		} else {
+			names[arr.Name] = path
+		}
+		switch arr.Archives {
+		case "", "extract", "fail":
+		default:
+			problems.add(path+".archives", "must be extract or fail, not %q", arr.Archives)
+		}
+		checkHTTP(problems, path+".http", arr.HTTP)
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.Address); err != nil {
+		problems.add("server.address", "must be host:port or :port, %v", err)
+	}
+
+	for i, n := range c.Notifications {
+		path := fmt.Sprintf("notifications[%d]", i)
+		if n.Type == "" {
+			problems.add(path+".type", "is required")
+		}
+		checkURL(problems, path+".url", n.URL)
+		checkNotNegative(problems, path+".retries", n.Retries)
+		checkHTTP(problems, path+".http", n.HTTP)
+	}
+
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			problems.add("log_level", "must be debug, info, warn or error, not %q", c.LogLevel)
+		}
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "", "text", "json":
+	default:
+		problems.add("log_format", "must be text or json, not %q", c.LogFormat)
+	}
+}
+
+func checkURL(problems *ConfigError, path, value string) {
+	if value == "" {
+		problems.add(path, "is required")
+		return
+	}
+	u, err := gourl.Parse(value)
+	if err != nil {
+		problems.add(path, "invalid url: %v", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		problems.add(path, "must start with http:// or https://, got %q", value)
+		return
+	}
+	if u.Host == "" {
+		problems.add(path, "has no host: %q", value)
+	}
+}
+
+// checkRequired reports an empty setting, it returns false if there was a
+// problem
+func checkRequired(problems *ConfigError, path, value string) bool {
+	if value == "" {
+		problems.add(path, "is required")
+		return false
+	}
+	return true
+}
+
+// checkFolder reports a missing folder, or one blackhole can't write to
+func checkFolder(problems *ConfigError, path, folder string, writable bool) {
+	var err error
+	if writable {
+		err = CheckWritable(folder)
+	} else {
+		err = checkDir(folder)
+	}
+	if err != nil {
+		problems.add(path, "%v", err)
+	}
+}
+
+func checkDir(folder string) error {
+	info, err := os.Stat(folder)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist", folder)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", folder)
+	}
+	return nil
+}
+
+// CheckWritable makes sure a folder exists and files can be created in it
+func CheckWritable(folder string) error {
+	if err := checkDir(folder); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(folder, ".blackhole-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", folder, err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
+}
+
+func checkHTTP(problems *ConfigError, path string, conf HTTPConfig) {
+	if conf.Proxy != "" {
+		if _, err := parseProxy(conf.Proxy); err != nil {
+			problems.add(path+".proxy", "%v", err)
+		}
+	}
+	if conf.CAFile != "" {
+		if conf.InsecureSkipVerify {
+			problems.add(path+".insecure_skip_verify", "can't be used with ca_file, certificates are either verified or not")
+		}
+		if _, err := loadCAFile(conf.CAFile); err != nil {
+			problems.add(path+".ca_file", "%v", err)
+		}
+	}
+}
+
+func checkDuration(problems *ConfigError, path, value string) {
+	if value == "" {
+		return
+	}
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		problems.add(path, "must be a positive duration like 90m or 24h, not %q", value)
+	}
+}
+
+func checkNotNegative(problems *ConfigError, path string, value int) {
+	if value < 0 {
+		problems.add(path, "can't be negative")
+	}
+}
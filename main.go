@@ -2,21 +2,34 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"goBlack/cmd"
 	"goBlack/common"
-	"log"
+	"os"
 )
 
 func main() {
 	var configPath string
 	flag.StringVar(&configPath, "config", "config.json", "path to the config file")
+	flag.Usage = func() {
+		cmd.Usage(flag.CommandLine.Output())
+		_, _ = fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Load the config file
 	conf, err := common.LoadConfig(configPath)
 	if err != nil {
-		log.Fatal(err)
+		// Validation lists every problem on its own line, which slog would escape
+		_, _ = fmt.Fprintf(os.Stderr, "Error loading config %s: %v\n", configPath, err)
+		os.Exit(1)
+	}
+	if err := common.SetupLogger(conf.LogLevel, conf.LogFormat); err != nil {
+		common.Fatal("Error setting up logging", "error", err)
+	}
+	if err := cmd.Run(conf, flag.Args()); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
-	cmd.Start(conf)
-
 }
@@ -0,0 +1,135 @@
+package archive
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+var (
+	ARCHIVEMATCH = regexp.MustCompile(`(?i)\.(rar|r\d{2,3}|zip|z\d{2}|7z|\d{3})$`)
+	rarPartMatch = regexp.MustCompile(`(?i)\.part0*(\d+)\.rar$`)
+
+	ErrUnsupported = errors.New("unsupported archive format")
+)
+
+// IsArchive reports whether a file is an archive or a part of one
+func IsArchive(name string) bool {
+	return ARCHIVEMATCH.MatchString(name)
+}
+
+// IsFirstVolume reports whether a file is where extraction of its archive starts
+func IsFirstVolume(name string) bool {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".rar"):
+		matches := rarPartMatch.FindStringSubmatch(lower)
+		// name.rar, or name.part1.rar for the newer volume naming
+		return matches == nil || matches[1] == "1"
+	case strings.HasSuffix(lower, ".zip"):
+		return true
+	default:
+		return false
+	}
+}
+
+// Extract unpacks an archive into dest and returns the paths of the extracted
+// files. Multi-volume RAR sets are read from the volumes next to the first one.
+func Extract(src, dest string) ([]string, error) {
+	lower := strings.ToLower(src)
+	switch {
+	case strings.HasSuffix(lower, ".rar"):
+		return extractRar(src, dest)
+	case strings.HasSuffix(lower, ".zip"):
+		return extractZip(src, dest)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, filepath.Base(src))
+	}
+}
+
+func extractRar(src, dest string) ([]string, error) {
+	r, err := rardecode.OpenReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	extracted := make([]string, 0)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return extracted, nil
+		}
+		if err != nil {
+			return extracted, err
+		}
+		if header.IsDir {
+			continue
+		}
+		if header.Encrypted {
+			return extracted, fmt.Errorf("%w: %s is password protected", ErrUnsupported, filepath.Base(src))
+		}
+		target, err := writeFile(dest, header.Name, r)
+		if err != nil {
+			return extracted, err
+		}
+		extracted = append(extracted, target)
+	}
+}
+
+func extractZip(src, dest string) ([]string, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	extracted := make([]string, 0, len(r.File))
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return extracted, err
+		}
+		target, err := writeFile(dest, f.Name, rc)
+		_ = rc.Close()
+		if err != nil {
+			return extracted, err
+		}
+		extracted = append(extracted, target)
+	}
+	return extracted, nil
+}
+
+// writeFile copies an archive entry to dest, refusing names that would escape it
+func writeFile(dest, name string, r io.Reader) (string, error) {
+	target := filepath.Join(dest, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dest, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("archive entry outside of destination: %s", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return "", err
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
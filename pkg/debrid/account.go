@@ -0,0 +1,193 @@
+package debrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goBlack/common"
+	"goBlack/pkg/notify"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAccountInterval = time.Hour
+	defaultExpiryWarning   = 7
+	expiryWarningRepeat    = 24 * time.Hour
+	// expiredInterval checks an expired account more often, jobs wait for it
+	expiredInterval = 10 * time.Minute
+)
+
+var ErrAccountExpired = errors.New("debrid account has no premium left")
+
+// Account is the state of a debrid account
+type Account struct {
+	Username    string        `json:"username"`
+	Premium     bool          `json:"premium"`
+	PremiumLeft time.Duration `json:"premium_left"`
+	Expiration  time.Time     `json:"expiration"`
+	Points      int           `json:"points"`
+	TrafficUsed int64         `json:"traffic_used"`
+}
+
+// AccountStatus is the last known state of an account
+type AccountStatus struct {
+	Debrid    string    `json:"debrid"`
+	Account   *Account  `json:"account,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AccountMonitor checks a debrid account periodically and warns before the
+// premium runs out
+type AccountMonitor struct {
+	name        string
+	fetch       func() (*Account, error)
+	interval    time.Duration
+	warnBelow   time.Duration
+	mu          sync.RWMutex
+	status      AccountStatus
+	lastWarning time.Time
+	start       sync.Once
+	checked     chan struct{} // closed on every successful check
+}
+
+func NewAccountMonitor(dc common.DebridConfig, fetch func() (*Account, error)) *AccountMonitor {
+	interval, err := time.ParseDuration(dc.AccountInterval)
+	if err != nil || interval <= 0 {
+		interval = defaultAccountInterval
+	}
+	days := dc.ExpiryWarning
+	if days <= 0 {
+		days = defaultExpiryWarning
+	}
+	return &AccountMonitor{
+		name:      dc.Name,
+		fetch:     fetch,
+		interval:  interval,
+		warnBelow: time.Duration(days) * 24 * time.Hour,
+		status:    AccountStatus{Debrid: dc.Name},
+		checked:   make(chan struct{}),
+	}
+}
+
+// Start checks the account now and then at every interval in the background
+func (m *AccountMonitor) Start() {
+	m.start.Do(func() {
+		go func() {
+			for {
+				m.Check()
+				if m.Expired() {
+					time.Sleep(min(m.interval, expiredInterval))
+				} else {
+					time.Sleep(m.interval)
+				}
+			}
+		}()
+	})
+}
+
+// Check refreshes the account state
+func (m *AccountMonitor) Check() {
+	account, err := m.fetch()
+	m.mu.Lock()
+	m.status.CheckedAt = time.Now()
+	if err != nil {
+		// Keep the last known account, an outage doesn't mean it expired
+		m.status.Error = err.Error()
+		m.mu.Unlock()
+		slog.Error("Error checking debrid account", "debrid", m.name, "error", err)
+		return
+	}
+	m.status.Account = account
+	m.status.Error = ""
+	status := m.status
+	close(m.checked)
+	m.checked = make(chan struct{})
+	m.mu.Unlock()
+
+	common.DebridPremium.WithLabelValues(m.name).Set(account.PremiumLeft.Seconds())
+	common.DebridPoints.WithLabelValues(m.name).Set(float64(account.Points))
+	common.DebridTraffic.WithLabelValues(m.name).Set(float64(account.TrafficUsed))
+	if err := m.save(status); err != nil {
+		slog.Error("Error saving debrid account", "debrid", m.name, "error", err)
+	}
+	m.warn(account)
+}
+
+func (m *AccountMonitor) warn(account *Account) {
+	if account.PremiumLeft >= m.warnBelow {
+		return
+	}
+	m.mu.Lock()
+	if time.Since(m.lastWarning) < expiryWarningRepeat {
+		m.mu.Unlock()
+		return
+	}
+	m.lastWarning = time.Now()
+	m.mu.Unlock()
+
+	days := int(account.PremiumLeft.Hours() / 24)
+	left := fmt.Sprintf("%d days", days)
+	if !account.Premium || account.PremiumLeft <= 0 {
+		left = "0 days, it has expired"
+	}
+	slog.Warn("Debrid account is expiring", "debrid", m.name, "username", account.Username, "days_left", days)
+	notify.Notify(notify.Event{
+		Type:    notify.AccountExpiring,
+		Debrid:  m.name,
+		Message: left,
+	})
+}
+
+// Status returns the last known state of the account
+func (m *AccountMonitor) Status() AccountStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// Expired reports whether the account is known to have no premium left.
+// An account that hasn't been checked successfully yet is not expired.
+func (m *AccountMonitor) Expired() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	account := m.status.Account
+	return account != nil && (!account.Premium || account.PremiumLeft <= 0)
+}
+
+// Wait blocks until the account is not known to be expired or the context is
+// done. The account is rechecked by the monitor, renewing the premium lets
+// waiting jobs go on.
+func (m *AccountMonitor) Wait(ctx context.Context) error {
+	for {
+		m.mu.RLock()
+		checked := m.checked
+		m.mu.RUnlock()
+		if !m.Expired() {
+			return nil
+		}
+		select {
+		case <-checked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *AccountMonitor) save(status AccountStatus) error {
+	account := status.Account
+	_, err := common.GetDB().Exec(`
+		INSERT INTO account (debrid, username, premium, expiration, points, traffic, checked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(debrid) DO UPDATE SET
+		username = excluded.username,
+		premium = excluded.premium,
+		expiration = excluded.expiration,
+		points = excluded.points,
+		traffic = excluded.traffic,
+		checked_at = excluded.checked_at
+	`, m.name, account.Username, int64(account.PremiumLeft.Seconds()), account.Expiration.Unix(), account.Points, account.TrafficUsed, status.CheckedAt.Unix())
+	return err
+}
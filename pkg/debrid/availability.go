@@ -0,0 +1,166 @@
+package debrid
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"goBlack/common"
+	"goBlack/pkg/debrid/schema"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAvailabilityTTL = 30 * time.Minute
+	availabilityWindow     = 500 * time.Millisecond
+	maxAvailabilityBatch   = 50
+)
+
+type Availability struct {
+	InfoHash  string         `json:"info_hash"`
+	Cached    bool           `json:"cached"`
+	Hosters   schema.Hosters `json:"hosters"`
+	CheckedAt time.Time      `json:"checked_at"`
+}
+
+type availabilityResult struct {
+	availability *Availability
+	err          error
+}
+
+// AvailabilityService batches instant availability lookups into a single
+// request and caches the results in the database
+type AvailabilityService struct {
+	ttl     time.Duration
+	fetch   func(hashes []string) (schema.RealDebridAvailabilityResponse, error)
+	mu      sync.Mutex
+	pending map[string][]chan availabilityResult
+	timer   *time.Timer
+}
+
+func NewAvailabilityService(ttl time.Duration, fetch func(hashes []string) (schema.RealDebridAvailabilityResponse, error)) *AvailabilityService {
+	if ttl <= 0 {
+		ttl = defaultAvailabilityTTL
+	}
+	return &AvailabilityService{
+		ttl:     ttl,
+		fetch:   fetch,
+		pending: make(map[string][]chan availabilityResult),
+	}
+}
+
+// Check returns the availability of a hash, from the cache if it is fresh or
+// from the next batched request otherwise
+func (s *AvailabilityService) Check(infoHash string) (*Availability, error) {
+	infoHash = strings.ToLower(infoHash)
+	if a, ok := s.Lookup(infoHash); ok {
+		return a, nil
+	}
+	result := make(chan availabilityResult, 1)
+	s.mu.Lock()
+	s.pending[infoHash] = append(s.pending[infoHash], result)
+	common.QueueDepth.WithLabelValues("availability").Set(float64(len(s.pending)))
+	if len(s.pending) >= maxAvailabilityBatch {
+		batch := s.takePending()
+		go s.flush(batch)
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(availabilityWindow, func() {
+			s.mu.Lock()
+			batch := s.takePending()
+			s.mu.Unlock()
+			s.flush(batch)
+		})
+	}
+	s.mu.Unlock()
+	r := <-result
+	return r.availability, r.err
+}
+
+// Lookup returns the cached availability of a hash without making a request
+func (s *AvailabilityService) Lookup(infoHash string) (*Availability, bool) {
+	infoHash = strings.ToLower(infoHash)
+	row := common.GetDB().QueryRow(`
+		SELECT cached, hosters, checked_at FROM availability WHERE info_hash = ?
+	`, infoHash)
+	var (
+		cached    bool
+		hosters   string
+		checkedAt int64
+	)
+	if err := row.Scan(&cached, &hosters, &checkedAt); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Error reading availability", "info_hash", infoHash, "error", err)
+		}
+		return nil, false
+	}
+	a := &Availability{
+		InfoHash:  infoHash,
+		Cached:    cached,
+		CheckedAt: time.Unix(checkedAt, 0),
+	}
+	if time.Since(a.CheckedAt) > s.ttl {
+		return nil, false
+	}
+	_ = json.Unmarshal([]byte(hosters), &a.Hosters)
+	return a, true
+}
+
+// takePending must be called with the lock held
+func (s *AvailabilityService) takePending() map[string][]chan availabilityResult {
+	batch := s.pending
+	s.pending = make(map[string][]chan availabilityResult)
+	common.QueueDepth.WithLabelValues("availability").Set(0)
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	return batch
+}
+
+func (s *AvailabilityService) flush(batch map[string][]chan availabilityResult) {
+	if len(batch) == 0 {
+		return
+	}
+	hashes := make([]string, 0, len(batch))
+	for hash := range batch {
+		hashes = append(hashes, hash)
+	}
+	data, err := s.fetch(hashes)
+	now := time.Now()
+	for _, hash := range hashes {
+		result := availabilityResult{err: err}
+		if err == nil {
+			hosters := data[hash]
+			result.availability = &Availability{
+				InfoHash:  hash,
+				Cached:    len(hosters) > 0,
+				Hosters:   hosters,
+				CheckedAt: now,
+			}
+			if err := s.save(result.availability); err != nil {
+				slog.Error("Error saving availability", "info_hash", hash, "error", err)
+			}
+		}
+		for _, ch := range batch[hash] {
+			ch <- result
+		}
+	}
+}
+
+func (s *AvailabilityService) save(a *Availability) error {
+	hosters, err := json.Marshal(a.Hosters)
+	if err != nil {
+		return err
+	}
+	_, err = common.GetDB().Exec(`
+		INSERT INTO availability (info_hash, cached, hosters, checked_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(info_hash) DO UPDATE SET
+		cached = excluded.cached,
+		hosters = excluded.hosters,
+		checked_at = excluded.checked_at
+	`, a.InfoHash, a.Cached, string(hosters), a.CheckedAt.Unix())
+	return err
+}
@@ -2,23 +2,36 @@ package debrid
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/anacrolix/torrent/metainfo"
 	"goBlack/common"
 	"goBlack/pkg"
-	"log"
+	"goBlack/pkg/magnet"
+	"log/slog"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 type Service interface {
 	SubmitMagnet(torrent *pkg.Torrent) (*pkg.Torrent, error)
+	SubmitTorrentFile(torrent *pkg.Torrent) (*pkg.Torrent, error)
 	CheckStatus(torrent *pkg.Torrent) (*pkg.Torrent, error)
 	DownloadLink(torrent *pkg.Torrent) error
-	Process(arr *pkg.Arr, magnet string) (*pkg.Torrent, error)
+	Process(torrent *pkg.Torrent) (*pkg.Torrent, error)
 	IsAvailable(torrent *pkg.Torrent) bool
+	Availability() *AvailabilityService
+	DeleteTorrent(torrent *pkg.Torrent) error
+	GetAccount() (*Account, error)
+	CheckToken(ctx context.Context) error // asks the debrid whether the API key works
+	Monitor() *AccountMonitor
+	Circuit() *common.Breaker      // circuit breaker of the debrid host
+	Reload(dc common.DebridConfig) // applies the settings that can change without a restart
+	SetReauth(reauth func())       // called to load a new API key when the debrid rejects it
 }
 
 type Debrid struct {
@@ -27,30 +40,61 @@ type Debrid struct {
 	DownloadUncached bool
 }
 
-func NewDebrid(dc common.DebridConfig) Service {
+func NewDebrid(dc common.DebridConfig) (Service, error) {
+	var (
+		deb *RealDebrid
+		err error
+	)
 	switch dc.Name {
 	case "realdebrid":
-		return NewRealDebrid(dc)
+		deb, err = NewRealDebrid(dc)
 	default:
-		return NewRealDebrid(dc)
+		deb, err = NewRealDebrid(dc)
 	}
+	if err != nil {
+		// A nil *RealDebrid would be a non-nil Service
+		return nil, err
+	}
+	return deb, nil
 }
 
-func GetTorrentInfo(filePath string) (*pkg.Torrent, error) {
+// GetTorrents reads the torrents of a watch file. A .torrent file holds one,
+// .magnet and .txt files hold one magnet link or info hash per line.
+func GetTorrents(filePath string) ([]*pkg.Torrent, error) {
 	// Open and read the .torrent file
 	if filepath.Ext(filePath) == ".torrent" {
-		return getTorrentInfo(filePath)
-	} else {
-		return getMagnetInfo(filePath)
+		torrent, err := getTorrentInfo(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return []*pkg.Torrent{torrent}, nil
 	}
-
+	lines := openMagnetFile(filePath)
+	torrents := make([]*pkg.Torrent, 0, len(lines))
+	for _, line := range lines {
+		magnetLink, err := parseMagnetLine(line)
+		if err != nil {
+			slog.Warn("Skipping line in watch file", "file", filePath, "error", err)
+			continue
+		}
+		torrent, err := getMagnetInfo(magnetLink, filePath)
+		if err != nil {
+			slog.Warn("Skipping line in watch file", "file", filePath, "error", err)
+			continue
+		}
+		torrents = append(torrents, torrent)
+	}
+	if len(torrents) == 0 {
+		return nil, fmt.Errorf("error getting magnet from file")
+	}
+	return torrents, nil
 }
 
-func openMagnetFile(filePath string) string {
+func openMagnetFile(filePath string) []string {
 	file, err := os.Open(filePath)
 	if err != nil {
-		log.Println("Error opening file:", err)
-		return ""
+		slog.Error("Error opening file", "file", filePath, "error", err)
+		return nil
 	}
 	defer func(file *os.File) {
 		err := file.Close()
@@ -60,52 +104,89 @@ func openMagnetFile(filePath string) string {
 	}(file) // Ensure the file is closed after the function ends
 
 	// Create a scanner to read the file line by line
+	lines := make([]string, 0)
 	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 	for scanner.Scan() {
-		magnetLink := scanner.Text()
-		if magnetLink != "" {
-			return magnetLink
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
 		}
 	}
 
 	// Check for any errors during scanning
 	if err := scanner.Err(); err != nil {
-		log.Println("Error reading file:", err)
+		slog.Error("Error reading file", "file", filePath, "error", err)
 	}
-	return ""
+	return lines
 }
 
-func getMagnetInfo(filePath string) (*pkg.Torrent, error) {
-	magnetLink := openMagnetFile(filePath)
-	if magnetLink == "" {
-		return nil, fmt.Errorf("error getting magnet from file")
+// parseMagnetLine turns a line of a watch file into a magnet link. Lines can be
+// magnet links, URL-encoded magnet links or bare info hashes.
+func parseMagnetLine(line string) (string, error) {
+	if strings.HasPrefix(strings.ToLower(line), "magnet%3a") {
+		decoded, err := url.QueryUnescape(line)
+		if err != nil {
+			return "", fmt.Errorf("error decoding magnet link")
+		}
+		line = decoded
 	}
-	magnetURI, err := url.Parse(magnetLink)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing magnet link")
+	if strings.HasPrefix(strings.ToLower(line), "magnet:") {
+		return line, nil
+	}
+	if hash, err := magnet.NormalizeInfoHash(line); err == nil {
+		return "magnet:?xt=urn:btih:" + hash, nil
 	}
-	query := magnetURI.Query()
-	xt := query.Get("xt")
-	dn := query.Get("dn")
+	return "", fmt.Errorf("not a magnet link or info hash: %.60s", line)
+}
 
-	// Extract BTIH
-	parts := strings.Split(xt, ":")
-	btih := ""
-	if len(parts) > 2 {
-		btih = parts[2]
+func getMagnetInfo(magnetLink, filePath string) (*pkg.Torrent, error) {
+	m, err := magnet.Parse(magnetLink)
+	if err != nil {
+		return nil, err
+	}
+	name := m.Name
+	if name == "" {
+		name = m.InfoHash
 	}
 	torrent := &pkg.Torrent{
-		InfoHash: btih,
-		Name:     dn,
-		Size:     0,
+		Id:       pkg.NewTorrentId(),
+		InfoHash: m.InfoHash,
+		Name:     name,
+		Size:     m.Size,
 		Magnet:   magnetLink,
+		Trackers: m.Trackers,
 		Filename: filePath,
 	}
 	return torrent, nil
 }
 
+// ParseMagnet reads a torrent from a magnet link or info hash that didn't come
+// from a watch file
+func ParseMagnet(line string) (*pkg.Torrent, error) {
+	magnetLink, err := parseMagnetLine(strings.TrimSpace(line))
+	if err != nil {
+		return nil, err
+	}
+	return getMagnetInfo(magnetLink, "")
+}
+
 func getTorrentInfo(filePath string) (*pkg.Torrent, error) {
-	mi, err := metainfo.LoadFromFile(filePath)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	torrent, err := ParseTorrentFile(data)
+	if err != nil {
+		return nil, err
+	}
+	torrent.Filename = filePath
+	return torrent, nil
+}
+
+// ParseTorrentFile reads a torrent from the contents of a .torrent file
+func ParseTorrentFile(data []byte) (*pkg.Torrent, error) {
+	mi, err := metainfo.Load(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
@@ -115,12 +196,30 @@ func getTorrentInfo(filePath string) (*pkg.Torrent, error) {
 	if err != nil {
 		return nil, err
 	}
+	files := make([]pkg.File, 0)
+	for i, f := range info.UpvertedFiles() {
+		// Single file torrents have no path, the file is named after the torrent
+		name := "/" + info.Name
+		if len(f.BestPath()) > 0 {
+			name = "/" + strings.Join(f.BestPath(), "/")
+		}
+		files = append(files, pkg.File{
+			// Debrid file ids follow the order of the metainfo, starting at 1
+			Id:   strconv.Itoa(i + 1),
+			Name: name,
+			Path: name,
+			Size: f.Length,
+		})
+	}
 	torrent := &pkg.Torrent{
+		Id:       pkg.NewTorrentId(),
 		InfoHash: infoHash,
 		Name:     info.Name,
-		Size:     info.Length,
+		Size:     info.TotalLength(),
+		Files:    files,
 		Magnet:   mi.Magnet(&hash, &info).String(),
-		Filename: filePath,
+		Trackers: mi.UpvertedAnnounceList().DistinctValues(),
+		Data:     data,
 	}
 	return torrent, nil
 }
@@ -0,0 +1,83 @@
+package debrid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goBlack/common"
+)
+
+// Errors the debrid reports, check them with errors.Is. The errors returned
+// are *RealDebridError with the details.
+var (
+	ErrBadToken         = errors.New("debrid api key is invalid or expired")
+	ErrPermissionDenied = errors.New("debrid account is not allowed to do this")
+	ErrAccountLimit     = errors.New("debrid account is out of traffic")
+	ErrSlotsFull        = errors.New("debrid account has too many active downloads")
+	ErrInfringingFile   = errors.New("debrid refuses an infringing file")
+	ErrInvalidTorrent   = errors.New("debrid refuses the torrent")
+	ErrBadParameter     = errors.New("debrid rejected a parameter")
+)
+
+// realDebridCodes maps the error_code of Real-Debrid to the errors above,
+// https://api.real-debrid.com/#api_error_codes
+var realDebridCodes = map[int]error{
+	2:  ErrBadParameter,
+	8:  ErrBadToken,
+	9:  ErrPermissionDenied,
+	14: ErrPermissionDenied, // account locked
+	15: ErrPermissionDenied, // account not activated
+	20: ErrAccountExpired,   // not available for free users
+	21: ErrSlotsFull,
+	22: ErrPermissionDenied, // ip address not allowed
+	23: ErrAccountLimit,     // traffic exhausted
+	28: ErrInvalidTorrent,   // file not allowed
+	29: ErrInvalidTorrent,   // torrent too big
+	30: ErrInvalidTorrent,   // torrent file invalid
+	35: ErrInfringingFile,
+	36: ErrAccountLimit, // fair usage limit
+}
+
+// RealDebridError is an error response of the Real-Debrid API
+type RealDebridError struct {
+	Code    int    `json:"error_code"`
+	Message string `json:"error"` // bad_token, infringing_file
+	HTTP    *common.HTTPError
+}
+
+func (e *RealDebridError) Error() string {
+	return fmt.Sprintf("real-debrid: %s (error_code %d, status %d)", e.Message, e.Code, e.HTTP.StatusCode)
+}
+
+// Is matches the error the code maps to
+func (e *RealDebridError) Is(target error) bool {
+	return realDebridCodes[e.Code] == target
+}
+
+func (e *RealDebridError) Unwrap() error {
+	return e.HTTP
+}
+
+// parseError turns an error response with an error_code into a
+// *RealDebridError, other errors are returned as they are
+func parseError(err error) error {
+	var httpErr *common.HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+	rdErr := &RealDebridError{HTTP: httpErr}
+	if json.Unmarshal(httpErr.Body, rdErr) != nil || rdErr.Message == "" {
+		return err
+	}
+	return rdErr
+}
+
+// IsAccountError reports whether an error is caused by the debrid account. A
+// different release would fail the same way, so the arr isn't told to look
+// for one.
+func IsAccountError(err error) bool {
+	return errors.Is(err, ErrBadToken) ||
+		errors.Is(err, ErrPermissionDenied) ||
+		errors.Is(err, ErrAccountLimit) ||
+		errors.Is(err, ErrAccountExpired)
+}
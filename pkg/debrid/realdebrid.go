@@ -1,77 +1,315 @@
 package debrid
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"goBlack/common"
 	"goBlack/pkg"
 	"goBlack/pkg/debrid/schema"
-	"log"
+	"goBlack/pkg/notify"
+	"goBlack/pkg/selector"
+	"io"
+	"log/slog"
 	"net/http"
 	gourl "net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxUncachedWait = 24 * time.Hour
+	defaultMaxSlotWait     = 2 * time.Hour
+	seederGracePeriod      = 5 * time.Minute
+	slotRetryInterval      = time.Minute
 )
 
 type RealDebrid struct {
+	Name             string
 	Host             string `json:"host"`
 	APIKey           string
 	DownloadUncached bool
+	MaxUncachedWait  time.Duration
+	MaxSlotWait      time.Duration
+	MinSeeders       int
 	client           *common.RLHTTPClient
+	scheduler        *Scheduler
+	availability     *AvailabilityService
+	monitor          *AccountMonitor
+	uncachedSlots    chan struct{}
+	breaker          *common.Breaker
+	mu               sync.Mutex
+	reauth           func()
 }
 
-func (r *RealDebrid) Process(arr *pkg.Arr, magnet string) (*pkg.Torrent, error) {
-	torrent, err := GetTorrentInfo(magnet)
-	torrent.Arr = arr
+func (r *RealDebrid) Process(torrent *pkg.Torrent) (*pkg.Torrent, error) {
+	err := torrent.UpsertDB()
 	if err != nil {
-		return nil, err
+		return torrent, err
 	}
-	err = torrent.UpsertDB()
+	_ = torrent.SetStatus(pkg.StatusPending, nil)
+	torrent.Logger().Info("Processing torrent", "name", torrent.Name)
+	if err := inspectFiles(torrent); err != nil {
+		return torrent, err
+	}
+	// Nor do they fail while the premium has run out, it can be renewed
+	if err := r.waitPremium(torrent); err != nil {
+		return torrent, err
+	}
+	// Torrents stay pending while the debrid is down rather than failing
+	if err := r.waitReachable(torrent); err != nil {
+		return torrent, err
+	}
+	start := time.Now()
+	var available bool
+	err = r.hold(torrent, func() (err error) {
+		available, err = r.isAvailable(torrent)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return torrent, err
 	}
-	log.Printf("Torrent Name: %s", torrent.Name)
-	if !r.DownloadUncached {
-		if !r.IsAvailable(torrent) {
-			return nil, fmt.Errorf("torrent is not cached")
+	r.observeStage("availability", torrent, start)
+	if !available {
+		if !r.DownloadUncached {
+			return torrent, fmt.Errorf("torrent is not cached")
+		}
+		release, err := r.acquireUncachedSlot(torrent)
+		if err != nil {
+			return torrent, err
 		}
+		defer release()
 	}
-	err = torrent.UpsertDB()
+	start = time.Now()
+	err = r.hold(torrent, func() (err error) {
+		if len(torrent.Data) > 0 {
+			torrent, err = r.SubmitTorrentFile(torrent)
+		} else {
+			torrent, err = r.SubmitMagnet(torrent)
+		}
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return torrent, err
 	}
-	torrent, err = r.SubmitMagnet(torrent)
-
-	if err != nil || torrent.Id == "" {
-		return nil, err
+	r.observeStage("submit", torrent, start)
+	notify.Notify(notify.TorrentEvent(notify.Submitted, torrent, nil))
+	if torrent.DebridId == "" {
+		return torrent, fmt.Errorf("torrent: %s was not added to debrid", torrent.Name)
 	}
 	err = torrent.UpsertDB()
 	if err != nil {
-		return nil, err
+		return torrent, err
+	}
+
+	start = time.Now()
+	torrent, err = r.CheckStatus(torrent)
+	if err == nil {
+		r.observeStage("download", torrent, start)
+	}
+	return torrent, err
+}
+
+func (r *RealDebrid) observeStage(stage string, torrent *pkg.Torrent, start time.Time) {
+	common.StageDuration.WithLabelValues(stage, torrent.Arr.Name, r.Name).Observe(time.Since(start).Seconds())
+}
+
+// acquireUncachedSlot blocks until the account has room for another uncached
+// download or the job is cancelled, and returns a function that frees the slot
+func (r *RealDebrid) acquireUncachedSlot(torrent *pkg.Torrent) (func(), error) {
+	if r.uncachedSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case r.uncachedSlots <- struct{}{}:
+	default:
+		torrent.Logger().Info("Waiting for an uncached download slot")
+		common.QueueDepth.WithLabelValues("uncached").Inc()
+		defer common.QueueDepth.WithLabelValues("uncached").Dec()
+		select {
+		case r.uncachedSlots <- struct{}{}:
+		case <-torrent.Context().Done():
+			return nil, torrent.Context().Err()
+		}
+	}
+	return func() {
+		<-r.uncachedSlots
+	}, nil
+}
+
+// waitReachable holds a torrent while the circuit breaker of the debrid is open
+func (r *RealDebrid) waitReachable(torrent *pkg.Torrent) error {
+	if r.breaker.State() == common.CircuitClosed {
+		return nil
+	}
+	torrent.Logger().Warn("Debrid is unreachable, waiting", "host", r.breaker.Host())
+	common.QueueDepth.WithLabelValues("unreachable").Inc()
+	defer common.QueueDepth.WithLabelValues("unreachable").Dec()
+	return r.breaker.Wait(torrent.Context())
+}
+
+// waitPremium holds a torrent while the account has no premium
+func (r *RealDebrid) waitPremium(torrent *pkg.Torrent) error {
+	if !r.monitor.Expired() {
+		return nil
+	}
+	torrent.Logger().Warn("Debrid account has no premium left, waiting for it to be renewed")
+	common.QueueDepth.WithLabelValues("expired").Inc()
+	defer common.QueueDepth.WithLabelValues("expired").Dec()
+	return r.monitor.Wait(torrent.Context())
+}
+
+// hold runs a debrid call for a torrent, and runs it again once the debrid
+// is back, the account has a free slot or its premium was renewed. The
+// torrent stays pending meanwhile.
+func (r *RealDebrid) hold(torrent *pkg.Torrent, call func() error) error {
+	var waitingSince time.Time
+	for {
+		err := call()
+		switch {
+		case errors.Is(err, common.ErrCircuitOpen):
+			if err := r.waitReachable(torrent); err != nil {
+				return err
+			}
+		case errors.Is(err, ErrSlotsFull):
+			if waitingSince.IsZero() {
+				waitingSince = time.Now()
+			}
+			if time.Since(waitingSince) > r.MaxSlotWait {
+				return fmt.Errorf("no free slot after %s: %w", r.MaxSlotWait, err)
+			}
+			if err := r.waitForSlot(torrent); err != nil {
+				return err
+			}
+		case errors.Is(err, ErrAccountExpired):
+			// The monitor may not know yet, if it still sees premium the
+			// debrid refuses for another reason
+			r.monitor.Check()
+			if !r.monitor.Expired() {
+				return err
+			}
+			if err := r.waitPremium(torrent); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// waitForSlot waits before asking the debrid again, it doesn't say when one
+// of the active downloads finishes
+func (r *RealDebrid) waitForSlot(torrent *pkg.Torrent) error {
+	torrent.Logger().Info("Debrid account has too many active downloads, waiting for a slot")
+	common.QueueDepth.WithLabelValues("slots").Inc()
+	defer common.QueueDepth.WithLabelValues("slots").Dec()
+	timer := time.NewTimer(slotRetryInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-torrent.Context().Done():
+		return torrent.Context().Err()
+	}
+}
+
+// request sends a request to the API and parses its error responses. When the
+// API key is rejected, the reauth hook gets a chance to load a new one and the
+// request is sent once more.
+func (r *RealDebrid) request(method, url string, body []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		key := r.client.Header("Authorization")
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		resp, err := r.client.MakeRequest(method, url, reader)
+		err = parseError(err)
+		if attempt > 0 || !errors.Is(err, ErrBadToken) || !r.reauthenticate(key) {
+			return resp, err
+		}
 	}
+}
+
+// reauthenticate reports whether the API key changed from the one rejected
+func (r *RealDebrid) reauthenticate(rejected string) bool {
+	if r.client.Header("Authorization") != rejected {
+		// Another request loaded a new key already
+		return true
+	}
+	r.mu.Lock()
+	reauth := r.reauth
+	r.mu.Unlock()
+	if reauth == nil {
+		return false
+	}
+	slog.Warn("Debrid rejected the API key, reloading it", "debrid", r.Name)
+	reauth()
+	return r.client.Header("Authorization") != rejected
+}
 
-	return r.CheckStatus(torrent)
+// SetReauth sets what is done to load a new API key when the debrid rejects
+// the current one
+func (r *RealDebrid) SetReauth(reauth func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reauth = reauth
 }
 
 func (r *RealDebrid) IsAvailable(torrent *pkg.Torrent) bool {
-	url := fmt.Sprintf("%s/torrents/instantAvailability/%s", r.Host, torrent.InfoHash)
-	resp, err := r.client.MakeRequest(http.MethodGet, url, nil)
+	available, _ := r.isAvailable(torrent)
+	return available
+}
+
+// isAvailable only returns an error when the debrid is unreachable, other
+// errors count as not cached
+func (r *RealDebrid) isAvailable(torrent *pkg.Torrent) (bool, error) {
+	availability, err := r.availability.Check(torrent.InfoHash)
+	if errors.Is(err, common.ErrCircuitOpen) {
+		return false, err
+	}
 	if err != nil {
-		return false
+		torrent.Logger().Error("Error checking availability", "error", err)
+		return false, nil
+	}
+	if !availability.Cached {
+		torrent.Logger().Info("Torrent not cached")
+		notify.Notify(notify.TorrentEvent(notify.CachedMiss, torrent, nil))
+		common.TorrentsUncached.WithLabelValues(torrent.Arr.Name, r.Name).Inc()
+		return false, nil
+	}
+	torrent.Logger().Info("Torrent is cached")
+	common.TorrentsCached.WithLabelValues(torrent.Arr.Name, r.Name).Inc()
+	return true, nil
+}
+
+func (r *RealDebrid) checkAvailability(hashes []string) (schema.RealDebridAvailabilityResponse, error) {
+	url := fmt.Sprintf("%s/torrents/instantAvailability/%s", r.Host, strings.Join(hashes, "/"))
+	resp, err := r.request(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
 	var data schema.RealDebridAvailabilityResponse
 	err = json.Unmarshal(resp, &data)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	hosters, exists := data[strings.ToLower(torrent.InfoHash)]
-	if !exists || len(hosters) < 1 {
-		log.Printf("Torrent: %s not cached", torrent.Name)
-		return false
+	// Hashes come back in whatever case they were sent in
+	result := make(schema.RealDebridAvailabilityResponse, len(data))
+	for hash, hosters := range data {
+		result[strings.ToLower(hash)] = hosters
 	}
-	log.Printf("Torrent: %s is cached", torrent.Name)
-	return true
+	return result, nil
+}
+
+// Availability returns the shared instant availability service
+func (r *RealDebrid) Availability() *AvailabilityService {
+	return r.availability
 }
 
 func (r *RealDebrid) SubmitMagnet(torrent *pkg.Torrent) (*pkg.Torrent, error) {
@@ -80,92 +318,358 @@ func (r *RealDebrid) SubmitMagnet(torrent *pkg.Torrent) (*pkg.Torrent, error) {
 		"magnet": {torrent.Magnet},
 	}
 	var data schema.RealDebridAddMagnetSchema
-	resp, err := r.client.MakeRequest(http.MethodPost, url, strings.NewReader(payload.Encode()))
+	resp, err := r.request(http.MethodPost, url, []byte(payload.Encode()))
+	if errors.Is(err, ErrBadParameter) {
+		return torrent, fmt.Errorf("%w: %w", ErrInvalidTorrent, err)
+	}
 	if err != nil {
-		return nil, err
+		return torrent, err
+	}
+	err = json.Unmarshal(resp, &data)
+	if err != nil {
+		return torrent, err
+	}
+	torrent.Logger().Info("Magnet added", "debrid_id", data.Id)
+	torrent.DebridId = data.Id
+
+	return torrent, nil
+}
+
+// SubmitTorrentFile uploads the original .torrent file, which keeps the piece
+// data and private trackers a magnet would lose
+func (r *RealDebrid) SubmitTorrentFile(torrent *pkg.Torrent) (*pkg.Torrent, error) {
+	url := fmt.Sprintf("%s/torrents/addTorrent", r.Host)
+	var data schema.RealDebridAddMagnetSchema
+	resp, err := r.request(http.MethodPut, url, torrent.Data)
+	if err != nil {
+		return torrent, err
 	}
 	err = json.Unmarshal(resp, &data)
-	log.Printf("Torrent: %s added with id: %s\n", torrent.Name, data.Id)
-	torrent.Id = data.Id
+	if err != nil {
+		return torrent, err
+	}
+	torrent.Logger().Info("Torrent file uploaded", "debrid_id", data.Id)
+	torrent.DebridId = data.Id
 
 	return torrent, nil
 }
 
 func (r *RealDebrid) CheckStatus(torrent *pkg.Torrent) (*pkg.Torrent, error) {
-	url := fmt.Sprintf("%s/torrents/info/%s", r.Host, torrent.Id)
+	updates := r.scheduler.Track(torrent.DebridId)
+	defer r.scheduler.Untrack(torrent.DebridId)
+
+	var downloadStarted time.Time
+	filesSelected := false
 	for {
-		resp, err := r.client.MakeRequest(http.MethodGet, url, nil)
-		if err != nil {
-			return torrent, err
+		var update schema.RealDebridTorrent
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				return torrent, fmt.Errorf("status updates for %s stopped", torrent.DebridId)
+			}
+			update = u
+		case <-torrent.Context().Done():
+			return torrent, torrent.Context().Err()
 		}
-		var data schema.RealDebridTorrentInfo
-		err = json.Unmarshal(resp, &data)
-		status := data.Status
-		torrent.Folder = common.RemoveExtension(data.OriginalFilename)
-		if status == "error" || status == "dead" || status == "magnet_error" {
-			return torrent, fmt.Errorf("torrent: %s has error", torrent.Name)
-		} else if status == "waiting_files_selection" {
-			files := make([]pkg.File, 0)
-			for _, f := range data.Files {
-				name := f.Path
-				if !common.RegexMatch(common.VIDEOMATCH, name) && !common.RegexMatch(common.SUBMATCH, name) {
-					continue
-				}
-				fileId := f.ID
-				file := &pkg.File{
-					Name: name,
-					Path: filepath.Join(torrent.Folder, name),
-					Size: int64(f.Bytes),
-					Id:   strconv.Itoa(fileId),
-				}
-				files = append(files, *file)
+		if update.Status != torrent.Status {
+			torrent.Logger().Info("Status changed", "status", update.Status, "progress", update.Progress)
+			_ = torrent.SetStatus(update.Status, nil)
+		}
+		torrent.Progress = update.Progress
+		torrent.Speed = int64(update.Speed)
+		torrent.Seeders = update.Seeders
+		_ = torrent.UpdateProgress()
+
+		switch update.Status {
+		case "magnet_error", "error", "virus", "dead":
+			return torrent, fmt.Errorf("torrent: %s has status %s", torrent.Name, update.Status)
+		case statusNotFound:
+			return torrent, fmt.Errorf("torrent: %s no longer exists on debrid", torrent.Name)
+		case "magnet_conversion", "compressing", "uploading":
+			// Debrid is still working on it, wait for the next update
+		case "waiting_files_selection":
+			if filesSelected {
+				// Selection was sent, the list hasn't caught up yet
+				continue
 			}
-			torrent.Files = files
-			_ = torrent.UpsertDB()
-			if len(files) == 0 {
-				return torrent, fmt.Errorf("no video files found")
+			if err := r.hold(torrent, func() error { return r.selectFiles(torrent) }); err != nil {
+				return torrent, err
 			}
-			filesId := make([]string, 0)
-			for _, f := range files {
-				filesId = append(filesId, f.Id)
+			filesSelected = true
+		case "queued", "downloading":
+			if !r.DownloadUncached {
+				_ = r.DeleteTorrent(torrent)
+				return torrent, fmt.Errorf("torrent is uncached")
 			}
-			p := gourl.Values{
-				"files": {strings.Join(filesId, ",")},
+			if downloadStarted.IsZero() {
+				downloadStarted = time.Now()
+				torrent.Logger().Info("Torrent is uncached, downloading")
 			}
-			payload := strings.NewReader(p.Encode())
-			_, err = r.client.MakeRequest(http.MethodPost, fmt.Sprintf("%s/torrents/selectFiles/%s", r.Host, torrent.Id), payload)
-			if err != nil {
+			if err := r.checkUncached(torrent, downloadStarted); err != nil {
+				_ = r.DeleteTorrent(torrent)
 				return torrent, err
 			}
-		} else if status == "downloaded" {
-			log.Printf("Torrent: %s downloaded\n", torrent.Name)
-			err = r.DownloadLink(torrent)
-			if err != nil {
+		case "downloaded":
+			torrent.Logger().Info("Torrent downloaded")
+			notify.Notify(notify.TorrentEvent(notify.Downloaded, torrent, nil))
+			if !filesSelected {
+				// Files were selected by the debrid, read them back
+				if err := r.hold(torrent, func() error { return r.loadSelectedFiles(torrent) }); err != nil {
+					return torrent, err
+				}
+			}
+			if err := r.hold(torrent, func() error { return r.DownloadLink(torrent) }); err != nil {
 				return torrent, err
 			}
-			break
-		} else if status == "downloading" {
-			return torrent, fmt.Errorf("torrent is uncached")
+			return torrent, nil
+		default:
+			torrent.Logger().Warn("Unknown status", "status", update.Status)
 		}
+	}
+}
 
+func (r *RealDebrid) getInfo(torrent *pkg.Torrent) (*schema.RealDebridTorrentInfo, error) {
+	url := fmt.Sprintf("%s/torrents/info/%s", r.Host, torrent.DebridId)
+	resp, err := r.request(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
-	return torrent, nil
+	var data schema.RealDebridTorrentInfo
+	err = json.Unmarshal(resp, &data)
+	if err != nil {
+		return nil, err
+	}
+	torrent.Folder = common.RemoveExtension(data.OriginalFilename)
+	return &data, nil
+}
+
+func (r *RealDebrid) selectFiles(torrent *pkg.Torrent) error {
+	data, err := r.getInfo(torrent)
+	if err != nil {
+		return err
+	}
+	candidates := make([]selector.File, 0, len(data.Files))
+	for _, f := range data.Files {
+		candidates = append(candidates, selector.File{
+			Id:   strconv.Itoa(f.ID),
+			Path: f.Path,
+			Size: int64(f.Bytes),
+		})
+	}
+	files := make([]pkg.File, 0)
+	for _, f := range torrent.Arr.Selector.Select(candidates) {
+		files = append(files, pkg.File{
+			Name: f.Path,
+			Path: filepath.Join(torrent.Folder, f.Path),
+			Size: f.Size,
+			Id:   f.Id,
+		})
+	}
+	if len(files) == 0 {
+		files = archiveParts(torrent, candidates)
+		if files == nil {
+			torrent.Files = files
+			_ = torrent.UpsertDB()
+			_ = r.DeleteTorrent(torrent)
+			return fmt.Errorf("no files matched the selection rules")
+		}
+		if torrent.Arr.Archives != "extract" {
+			_ = r.DeleteTorrent(torrent)
+			return fmt.Errorf("torrent: %s %w", torrent.Name, ErrArchiveOnly)
+		}
+		torrent.Extract = true
+		torrent.Logger().Info("Torrent only contains archives, selecting parts to extract", "parts", len(files))
+	}
+	// A partial set of archive volumes can't be extracted, so only narrow down media
+	if availability, err := r.availability.Check(torrent.InfoHash); !torrent.Extract && err == nil && availability.Cached {
+		if cached := pickCachedVariant(files, availability.Hosters); cached != nil {
+			files = cached
+		} else {
+			// Every wanted file is selected, the debrid downloads what it hasn't cached
+			torrent.Logger().Warn("No cached variant holds every wanted file, the torrent is treated as uncached", "matched", len(files))
+		}
+	}
+	torrent.Files = files
+	_ = torrent.UpsertDB()
+	filesId := make([]string, 0)
+	for _, f := range files {
+		filesId = append(filesId, f.Id)
+	}
+	p := gourl.Values{
+		"files": {strings.Join(filesId, ",")},
+	}
+	_, err = r.request(http.MethodPost, fmt.Sprintf("%s/torrents/selectFiles/%s", r.Host, torrent.DebridId), []byte(p.Encode()))
+	return err
+}
+
+func (r *RealDebrid) loadSelectedFiles(torrent *pkg.Torrent) error {
+	data, err := r.getInfo(torrent)
+	if err != nil {
+		return err
+	}
+	files := make([]pkg.File, 0)
+	for _, f := range data.Files {
+		if f.Selected != 1 {
+			continue
+		}
+		files = append(files, pkg.File{
+			Name: f.Path,
+			Path: filepath.Join(torrent.Folder, f.Path),
+			Size: int64(f.Bytes),
+			Id:   strconv.Itoa(f.ID),
+		})
+	}
+	torrent.Files = files
+	return torrent.UpsertDB()
+}
+
+func (r *RealDebrid) listTorrents(page, limit int) ([]schema.RealDebridTorrent, error) {
+	url := fmt.Sprintf("%s/torrents?page=%d&limit=%d", r.Host, page, limit)
+	resp, err := r.request(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var data []schema.RealDebridTorrent
+	if len(resp) == 0 {
+		// An empty page is sent as 204 No Content
+		return data, nil
+	}
+	err = json.Unmarshal(resp, &data)
+	return data, err
+}
+
+// checkUncached enforces the wait and seeder limits on an uncached download
+func (r *RealDebrid) checkUncached(torrent *pkg.Torrent, started time.Time) error {
+	elapsed := time.Since(started)
+	if elapsed > r.MaxUncachedWait {
+		return fmt.Errorf("torrent: %s not downloaded after %s", torrent.Name, r.MaxUncachedWait)
+	}
+	// Seeders are only reported once the download has started
+	if torrent.Status != "downloading" {
+		return nil
+	}
+	if r.MinSeeders > 0 && elapsed > seederGracePeriod && torrent.Seeders < r.MinSeeders {
+		return fmt.Errorf("torrent: %s has %d seeders, minimum is %d", torrent.Name, torrent.Seeders, r.MinSeeders)
+	}
+	return nil
 }
 
 func (r *RealDebrid) DownloadLink(torrent *pkg.Torrent) error {
 	return nil
 }
 
-func NewRealDebrid(dc common.DebridConfig) *RealDebrid {
+func (r *RealDebrid) DeleteTorrent(torrent *pkg.Torrent) error {
+	url := fmt.Sprintf("%s/torrents/delete/%s", r.Host, torrent.DebridId)
+	_, err := r.request(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	torrent.Logger().Info("Torrent deleted from debrid")
+	return nil
+}
+
+// CheckToken makes a single /user call, unlike GetAccount it doesn't ask for
+// the traffic and gives up with the context
+func (r *RealDebrid) CheckToken(ctx context.Context) error {
+	_, err := r.client.MakeRequestContext(ctx, http.MethodGet, fmt.Sprintf("%s/user", r.Host), nil)
+	return parseError(err)
+}
+
+func (r *RealDebrid) GetAccount() (*Account, error) {
+	url := fmt.Sprintf("%s/user", r.Host)
+	resp, err := r.request(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var data schema.RealDebridUser
+	err = json.Unmarshal(resp, &data)
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{
+		Username:    data.Username,
+		Premium:     data.Type == "premium",
+		PremiumLeft: time.Duration(data.Premium) * time.Second,
+		Points:      data.Points,
+	}
+	if data.Expiration != "" {
+		account.Expiration, _ = time.Parse(time.RFC3339, data.Expiration)
+	}
+
+	resp, err = r.request(http.MethodGet, fmt.Sprintf("%s/traffic", r.Host), nil)
+	if err == nil {
+		var traffic schema.RealDebridTraffic
+		if json.Unmarshal(resp, &traffic) == nil {
+			for _, host := range traffic {
+				account.TrafficUsed += host.Bytes
+			}
+		}
+	}
+	return account, nil
+}
+
+func (r *RealDebrid) Monitor() *AccountMonitor {
+	return r.monitor
+}
+
+func (r *RealDebrid) Circuit() *common.Breaker {
+	return r.breaker
+}
+
+// Reload swaps the rate limit and the API key of the live client. Requests
+// already waiting on the old rate limit are left to finish.
+func (r *RealDebrid) Reload(dc common.DebridConfig) {
+	r.client.SetRateLimiter(common.ParseRateLimit(dc.RateLimit))
+	r.client.SetHeaders(authHeaders(dc.APIKey))
+}
+
+func authHeaders(apiKey string) map[string]string {
+	return map[string]string{
+		"Authorization": fmt.Sprintf("Bearer %s", apiKey),
+	}
+}
+
+func NewRealDebrid(dc common.DebridConfig) (*RealDebrid, error) {
+	tr, err := common.NewTransport(dc.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	if dc.HTTP.InsecureSkipVerify {
+		slog.Warn("TLS certificates of the debrid are not verified", "debrid", dc.Name)
+	}
 	rl := common.ParseRateLimit(dc.RateLimit)
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Bearer %s", dc.APIKey),
+	client := common.NewRLHTTPClient(rl, authHeaders(dc.APIKey), common.WithTransport(tr))
+	maxWait, err := time.ParseDuration(dc.MaxUncachedWait)
+	if err != nil || maxWait <= 0 {
+		maxWait = defaultMaxUncachedWait
+	}
+	maxSlotWait, err := time.ParseDuration(dc.MaxSlotWait)
+	if err != nil || maxSlotWait <= 0 {
+		maxSlotWait = defaultMaxSlotWait
 	}
-	client := common.NewRLHTTPClient(rl, headers)
-	return &RealDebrid{
+	var slots chan struct{}
+	if dc.MaxUncached > 0 {
+		slots = make(chan struct{}, dc.MaxUncached)
+	}
+	r := &RealDebrid{
+		Name:             dc.Name,
 		Host:             dc.Host,
 		APIKey:           dc.APIKey,
 		DownloadUncached: dc.DownloadUncached,
+		MaxUncachedWait:  maxWait,
+		MaxSlotWait:      maxSlotWait,
+		MinSeeders:       dc.MinSeeders,
 		client:           client,
+		uncachedSlots:    slots,
+	}
+	if u, err := gourl.Parse(dc.Host); err == nil {
+		r.breaker = common.BreakerFor(u.Host)
+	} else {
+		r.breaker = common.BreakerFor(dc.Host)
 	}
+	r.scheduler = NewScheduler(r.listTorrents)
+	ttl, _ := time.ParseDuration(dc.AvailabilityTTL)
+	r.availability = NewAvailabilityService(ttl, r.checkAvailability)
+	r.monitor = NewAccountMonitor(dc, r.GetAccount)
+	return r, nil
 }
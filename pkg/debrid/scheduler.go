@@ -0,0 +1,183 @@
+package debrid
+
+import (
+	"goBlack/common"
+	"goBlack/pkg/debrid/schema"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	fastPollInterval  = 2 * time.Second
+	slowPollInterval  = 30 * time.Second
+	maxPollInterval   = 2 * time.Minute
+	errorPollInterval = 30 * time.Second
+	listPageSize      = 100
+
+	// statusNotFound is sent when a tracked torrent is no longer on the account
+	statusNotFound = "not_found"
+	maxMisses      = 3
+)
+
+type statusJob struct {
+	updates chan schema.RealDebridTorrent
+	misses  int
+}
+
+// Scheduler refreshes every active torrent from the /torrents list in one go
+// and hands the latest status of each one to the job waiting on it
+type Scheduler struct {
+	mu    sync.Mutex
+	jobs  map[string]*statusJob
+	wake  chan struct{}
+	start sync.Once
+	list  func(page, limit int) ([]schema.RealDebridTorrent, error)
+}
+
+func NewScheduler(list func(page, limit int) ([]schema.RealDebridTorrent, error)) *Scheduler {
+	return &Scheduler{
+		jobs: make(map[string]*statusJob),
+		wake: make(chan struct{}, 1),
+		list: list,
+	}
+}
+
+// Track starts polling a torrent and returns the channel its updates are sent on.
+// Only the latest update is kept if the receiver falls behind.
+func (s *Scheduler) Track(id string) <-chan schema.RealDebridTorrent {
+	s.start.Do(func() {
+		go s.run()
+	})
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		job = &statusJob{updates: make(chan schema.RealDebridTorrent, 1)}
+		s.jobs[id] = job
+		common.QueueDepth.WithLabelValues("status").Inc()
+	}
+	s.mu.Unlock()
+	s.poke()
+	return job.updates
+}
+
+// Untrack stops polling a torrent
+func (s *Scheduler) Untrack(id string) {
+	s.mu.Lock()
+	if _, ok := s.jobs[id]; ok {
+		delete(s.jobs, id)
+		common.QueueDepth.WithLabelValues("status").Dec()
+	}
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs)
+}
+
+func (s *Scheduler) run() {
+	for {
+		if s.active() == 0 {
+			<-s.wake
+		}
+		interval, err := s.refresh()
+		if err != nil {
+			slog.Error("Error refreshing torrents", "error", err)
+			interval = errorPollInterval
+		}
+		select {
+		case <-time.After(interval):
+		case <-s.wake:
+		}
+	}
+}
+
+// refresh fetches pages of the torrent list until every tracked torrent has been
+// seen, then returns how long to wait before the next refresh
+func (s *Scheduler) refresh() (time.Duration, error) {
+	found := make(map[string]schema.RealDebridTorrent)
+	for page := 1; ; page++ {
+		items, err := s.list(page, listPageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range items {
+			found[item.ID] = item
+		}
+		if len(items) < listPageSize || s.allFound(found) {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	interval := maxPollInterval
+	for id, job := range s.jobs {
+		item, ok := found[id]
+		if !ok {
+			job.misses++
+			if job.misses < maxMisses {
+				interval = min(interval, fastPollInterval)
+				continue
+			}
+			item = schema.RealDebridTorrent{ID: id, Status: statusNotFound}
+		}
+		job.misses = 0
+		job.send(item)
+		interval = min(interval, nextPoll(item))
+	}
+	return interval, nil
+}
+
+func (s *Scheduler) allFound(found map[string]schema.RealDebridTorrent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.jobs {
+		if _, ok := found[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (j *statusJob) send(item schema.RealDebridTorrent) {
+	for {
+		select {
+		case j.updates <- item:
+			return
+		default:
+			// Drop the stale update the receiver hasn't read yet
+			select {
+			case <-j.updates:
+			default:
+			}
+		}
+	}
+}
+
+// nextPoll picks how soon a torrent needs another look. States that change
+// quickly are polled fast, downloads are polled based on their ETA.
+func nextPoll(item schema.RealDebridTorrent) time.Duration {
+	switch item.Status {
+	case "downloading":
+		if item.Speed <= 0 {
+			return slowPollInterval
+		}
+		remaining := float64(item.Bytes) * (100 - item.Progress) / 100
+		eta := time.Duration(remaining/float64(item.Speed)) * time.Second
+		return min(max(eta/4, fastPollInterval), maxPollInterval)
+	case "queued":
+		return slowPollInterval
+	default:
+		return fastPollInterval
+	}
+}
@@ -1,9 +1,25 @@
 package schema
 
+import "encoding/json"
+
 type RealDebridAvailabilityResponse map[string]Hosters
 
 type Hosters map[string][]FileIDs
 
+// UnmarshalJSON accepts the empty array Real-Debrid sends for uncached hashes
+func (h *Hosters) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		*h = Hosters{}
+		return nil
+	}
+	var hosters map[string][]FileIDs
+	if err := json.Unmarshal(data, &hosters); err != nil {
+		return err
+	}
+	*h = hosters
+	return nil
+}
+
 type FileIDs map[string]FileVariant
 
 type FileVariant struct {
@@ -17,17 +33,17 @@ type RealDebridAddMagnetSchema struct {
 }
 
 type RealDebridTorrentInfo struct {
-	ID               string `json:"id"`
-	Filename         string `json:"filename"`
-	OriginalFilename string `json:"original_filename"`
-	Hash             string `json:"hash"`
-	Bytes            int    `json:"bytes"`
-	OriginalBytes    int    `json:"original_bytes"`
-	Host             string `json:"host"`
-	Split            int    `json:"split"`
-	Progress         int    `json:"progress"`
-	Status           string `json:"status"`
-	Added            string `json:"added"`
+	ID               string  `json:"id"`
+	Filename         string  `json:"filename"`
+	OriginalFilename string  `json:"original_filename"`
+	Hash             string  `json:"hash"`
+	Bytes            int     `json:"bytes"`
+	OriginalBytes    int     `json:"original_bytes"`
+	Host             string  `json:"host"`
+	Split            int     `json:"split"`
+	Progress         float64 `json:"progress"`
+	Status           string  `json:"status"`
+	Added            string  `json:"added"`
 	Files            []struct {
 		ID       int    `json:"id"`
 		Path     string `json:"path"`
@@ -39,3 +55,41 @@ type RealDebridTorrentInfo struct {
 	Speed   int      `json:"speed,omitempty"`
 	Seeders int      `json:"seeders,omitempty"`
 }
+
+type RealDebridTorrent struct {
+	ID       string   `json:"id"`
+	Filename string   `json:"filename"`
+	Hash     string   `json:"hash"`
+	Bytes    int64    `json:"bytes"`
+	Host     string   `json:"host"`
+	Split    int      `json:"split"`
+	Progress float64  `json:"progress"`
+	Status   string   `json:"status"`
+	Added    string   `json:"added"`
+	Links    []string `json:"links"`
+	Ended    string   `json:"ended,omitempty"`
+	Speed    int      `json:"speed,omitempty"`
+	Seeders  int      `json:"seeders,omitempty"`
+}
+
+type RealDebridUser struct {
+	ID         int    `json:"id"`
+	Username   string `json:"username"`
+	Email      string `json:"email"`
+	Points     int    `json:"points"`
+	Locale     string `json:"locale"`
+	Avatar     string `json:"avatar"`
+	Type       string `json:"type"`    // premium or free
+	Premium    int    `json:"premium"` // seconds of premium left
+	Expiration string `json:"expiration"`
+}
+
+type RealDebridTraffic map[string]struct {
+	Left  int64  `json:"left"`
+	Bytes int64  `json:"bytes"`
+	Links int    `json:"links"`
+	Limit int64  `json:"limit"`
+	Type  string `json:"type"`
+	Extra int64  `json:"extra"`
+	Reset string `json:"reset"`
+}
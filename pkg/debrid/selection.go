@@ -0,0 +1,119 @@
+package debrid
+
+import (
+	"errors"
+	"fmt"
+	"goBlack/pkg"
+	"goBlack/pkg/archive"
+	"goBlack/pkg/debrid/schema"
+	"goBlack/pkg/selector"
+	"path/filepath"
+	"sort"
+)
+
+var ErrArchiveOnly = errors.New("only contains archives")
+
+func toCandidates(files []pkg.File) []selector.File {
+	candidates := make([]selector.File, 0, len(files))
+	for _, f := range files {
+		candidates = append(candidates, selector.File{
+			Id:   f.Id,
+			Path: f.Name,
+			Size: f.Size,
+		})
+	}
+	return candidates
+}
+
+// inspectFiles checks the file list read from a .torrent against the selection
+// rules of its arr, so unusable torrents are rejected before reaching the debrid.
+// Magnets have no file list until the debrid fetched their metadata.
+func inspectFiles(torrent *pkg.Torrent) error {
+	if len(torrent.Files) == 0 {
+		return nil
+	}
+	candidates := toCandidates(torrent.Files)
+	if torrent.Arr.Selector.Accepts(candidates) {
+		return nil
+	}
+	if archiveParts(torrent, candidates) == nil {
+		return fmt.Errorf("torrent: %s has no files matching the selection rules", torrent.Name)
+	}
+	if torrent.Arr.Archives != "extract" {
+		return fmt.Errorf("torrent: %s %w", torrent.Name, ErrArchiveOnly)
+	}
+	return nil
+}
+
+// archiveParts returns every archive part of a torrent, or nil if it has none
+// that can be extracted
+func archiveParts(torrent *pkg.Torrent, candidates []selector.File) []pkg.File {
+	var (
+		parts       []pkg.File
+		extractable bool
+	)
+	for _, f := range candidates {
+		if !archive.IsArchive(f.Path) {
+			continue
+		}
+		extractable = extractable || archive.IsFirstVolume(f.Path)
+		parts = append(parts, pkg.File{
+			Name: f.Path,
+			Path: filepath.Join(torrent.Folder, f.Path),
+			Size: f.Size,
+			Id:   f.Id,
+		})
+	}
+	if !extractable {
+		return nil
+	}
+	return parts
+}
+
+// pickCachedVariant returns the wanted files from a variant the debrid has
+// cached with every one of them, so selecting them results in an instant
+// download. Among those the variant with the fewest unwanted files, a pack's
+// .nfo or sample, is picked. It returns nil if no cached variant holds all
+// wanted files, narrowing to a partial one would drop wanted files.
+func pickCachedVariant(wanted []pkg.File, hosters schema.Hosters) []pkg.File {
+	byId := make(map[string]pkg.File, len(wanted))
+	for _, f := range wanted {
+		byId[f.Id] = f
+	}
+
+	var (
+		best      []pkg.File
+		bestExtra int
+	)
+	for _, variants := range hosters {
+		for _, variant := range variants {
+			files := make([]pkg.File, 0, len(variant))
+			for id := range variant {
+				if f, ok := byId[id]; ok {
+					files = append(files, f)
+				}
+			}
+			if len(files) < len(wanted) {
+				continue
+			}
+			extra := len(variant) - len(files)
+			if best == nil || extra < bestExtra {
+				best, bestExtra = files, extra
+			}
+		}
+	}
+	// Keep the torrent's file order
+	sort.Slice(best, func(i, j int) bool {
+		return indexOf(wanted, best[i].Id) < indexOf(wanted, best[j].Id)
+	})
+	return best
+}
+
+func indexOf(files []pkg.File, id string) int {
+	for i, f := range files {
+		if f.Id == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,89 @@
+package debrid
+
+import (
+	"goBlack/pkg"
+	"goBlack/pkg/debrid/schema"
+	"reflect"
+	"testing"
+)
+
+func fileIds(files []pkg.File) []string {
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, f.Id)
+	}
+	return ids
+}
+
+func variant(ids ...string) schema.FileIDs {
+	v := make(schema.FileIDs, len(ids))
+	for _, id := range ids {
+		v[id] = schema.FileVariant{}
+	}
+	return v
+}
+
+func TestPickCachedVariant(t *testing.T) {
+	episodes := []pkg.File{
+		{Id: "1", Name: "Show.S01E01.mkv", Size: 1000},
+		{Id: "2", Name: "Show.S01E02.mkv", Size: 1000},
+		{Id: "3", Name: "Show.S01E03.mkv", Size: 1200},
+	}
+	tests := []struct {
+		name    string
+		wanted  []pkg.File
+		hosters schema.Hosters
+		want    []string
+	}{
+		{
+			name:   "pack with an nfo beats exact single episodes",
+			wanted: episodes,
+			hosters: schema.Hosters{"rd": {
+				variant("1"),
+				variant("2"),
+				variant("3"),
+				variant("1", "2", "3", "4"), // 4 is the .nfo
+			}},
+			want: []string{"1", "2", "3"},
+		},
+		{
+			name:   "nil when no variant is complete",
+			wanted: episodes,
+			hosters: schema.Hosters{"rd": {
+				variant("1", "2"),
+				variant("3", "4", "5"),
+				variant("2", "3"),
+			}},
+			want: nil,
+		},
+		{
+			name:   "fewest unwanted files among complete variants",
+			wanted: episodes[:1],
+			hosters: schema.Hosters{"rd": {
+				variant("1", "4"),
+				variant("1"),
+			}},
+			want: []string{"1"},
+		},
+		{
+			name:    "nil without a variant holding a wanted file",
+			wanted:  episodes,
+			hosters: schema.Hosters{"rd": {variant("4")}},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pickCachedVariant(tt.wanted, tt.hosters)
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("got %v, want nil", fileIds(got))
+				}
+				return
+			}
+			if ids := fileIds(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Fatalf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrNoInfoHash = errors.New("magnet link has no bittorrent info hash")
+
+// Magnet is a parsed magnet link
+type Magnet struct {
+	InfoHash   string // v1 info hash as lower case hex, the truncated v2 hash for v2-only torrents
+	InfoHashV2 string // v2 SHA-256 info hash as lower case hex, empty for v1 torrents
+	Name       string
+	Trackers   []string
+	Size       int64
+}
+
+// Parse reads a magnet link. Every xt parameter is looked at, including the
+// numbered xt.1 form, so hybrid torrents get both hashes.
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet link: %w", err)
+	}
+	if !strings.EqualFold(u.Scheme, "magnet") {
+		return nil, fmt.Errorf("not a magnet link: %s", u.Scheme)
+	}
+	query, _ := url.ParseQuery(u.RawQuery)
+
+	m := &Magnet{}
+	for key, values := range query {
+		if key != "xt" && !strings.HasPrefix(key, "xt.") {
+			continue
+		}
+		for _, xt := range values {
+			if err := m.addExactTopic(xt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.InfoHash == "" {
+		if m.InfoHashV2 == "" {
+			return nil, ErrNoInfoHash
+		}
+		// v2-only swarms use the truncated hash where 20 bytes are expected
+		m.InfoHash = m.InfoHashV2[:40]
+	}
+
+	m.Name = query.Get("dn")
+	for key, values := range query {
+		if key == "tr" || strings.HasPrefix(key, "tr.") {
+			m.Trackers = append(m.Trackers, values...)
+		}
+	}
+	if xl := query.Get("xl"); xl != "" {
+		size, err := strconv.ParseInt(xl, 10, 64)
+		if err == nil && size > 0 {
+			m.Size = size
+		}
+	}
+	return m, nil
+}
+
+func (m *Magnet) addExactTopic(xt string) error {
+	lower := strings.ToLower(xt)
+	switch {
+	case strings.HasPrefix(lower, "urn:btih:"):
+		hash, err := NormalizeInfoHash(xt[len("urn:btih:"):])
+		if err != nil {
+			return err
+		}
+		if m.InfoHash == "" {
+			m.InfoHash = hash
+		}
+	case strings.HasPrefix(lower, "urn:btmh:"):
+		hash, err := parseMultihash(xt[len("urn:btmh:"):])
+		if err != nil {
+			return err
+		}
+		if m.InfoHashV2 == "" {
+			m.InfoHashV2 = hash
+		}
+	}
+	// Other urns (ed2k, sha1 ...) don't identify a torrent
+	return nil
+}
+
+// NormalizeInfoHash turns a v1 info hash, either 40 hex or 32 base32
+// characters, into lower case hex
+func NormalizeInfoHash(hash string) (string, error) {
+	switch len(hash) {
+	case 40:
+		if _, err := hex.DecodeString(hash); err != nil {
+			return "", fmt.Errorf("invalid hex info hash: %s", hash)
+		}
+		return strings.ToLower(hash), nil
+	case 32:
+		b, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		if err != nil {
+			return "", fmt.Errorf("invalid base32 info hash: %s", hash)
+		}
+		return hex.EncodeToString(b), nil
+	default:
+		return "", fmt.Errorf("invalid info hash length %d: %s", len(hash), hash)
+	}
+}
+
+// parseMultihash reads a v2 btmh value, which must be a SHA-256 multihash
+// (0x12 function code, 0x20 length)
+func parseMultihash(value string) (string, error) {
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != 34 || b[0] != 0x12 || b[1] != 0x20 {
+		return "", fmt.Errorf("invalid v2 info hash: %s", value)
+	}
+	return hex.EncodeToString(b[2:]), nil
+}
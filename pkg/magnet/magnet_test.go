@@ -0,0 +1,138 @@
+package magnet
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+const (
+	hexHash    = "c9e15763f722f23e98a29decdfae341b98d53056"
+	base32Hash = "ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMCW"
+	v2Hash     = "d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb"
+)
+
+var hexInfoHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want Magnet
+	}{
+		{
+			name: "btih hex",
+			uri:  "magnet:?xt=urn:btih:" + "C9E15763F722F23E98A29DECDFAE341B98D53056" + "&dn=Movie&tr=udp://a&tr=udp://b&xl=1000",
+			want: Magnet{InfoHash: hexHash, Name: "Movie", Trackers: []string{"udp://a", "udp://b"}, Size: 1000},
+		},
+		{
+			name: "btih base32",
+			uri:  "magnet:?xt=urn:btih:" + base32Hash,
+			want: Magnet{InfoHash: hexHash},
+		},
+		{
+			name: "btmh v2 only",
+			uri:  "magnet:?xt=urn:btmh:1220" + v2Hash,
+			want: Magnet{InfoHash: v2Hash[:40], InfoHashV2: v2Hash},
+		},
+		{
+			name: "hybrid",
+			uri:  "magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:1220" + v2Hash,
+			want: Magnet{InfoHash: hexHash, InfoHashV2: v2Hash},
+		},
+		{
+			name: "numbered xt",
+			uri:  "magnet:?xt.1=urn:ed2k:abc&xt.2=urn:btih:" + hexHash,
+			want: Magnet{InfoHash: hexHash},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse(tt.uri)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if m.InfoHash != tt.want.InfoHash || m.InfoHashV2 != tt.want.InfoHashV2 ||
+				m.Name != tt.want.Name || m.Size != tt.want.Size || len(m.Trackers) != len(tt.want.Trackers) {
+				t.Fatalf("got %+v, want %+v", *m, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := Parse("magnet:?dn=Movie"); !errors.Is(err, ErrNoInfoHash) {
+		t.Errorf("no xt: got %v, want ErrNoInfoHash", err)
+	}
+	for _, uri := range []string{
+		"http://example.com/?xt=urn:btih:" + hexHash,
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btmh:1120" + v2Hash,
+	} {
+		if _, err := Parse(uri); err == nil {
+			t.Errorf("Parse(%q) accepted an invalid magnet", uri)
+		}
+	}
+}
+
+func TestNormalizeInfoHash(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: hexHash, want: hexHash},
+		{in: "C9E15763F722F23E98A29DECDFAE341B98D53056", want: hexHash},
+		{in: base32Hash, want: hexHash},
+		{in: "zhqvoy7xelzd5gfctxwn7lrudomnkmcw", want: hexHash},
+		{in: "", err: true},
+		{in: hexHash[:39], err: true},
+		{in: "z9e15763f722f23e98a29decdfae341b98d53056", err: true},
+		{in: "ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMC1", err: true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeInfoHash(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("NormalizeInfoHash(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestParseMultihash(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "1220" + v2Hash, want: v2Hash},
+		{in: "1220" + "D8DD32AC93357C368556AF3AC1D95C9D76BD0DFF6FA9833ECDAC3D53134EFABB", want: v2Hash},
+		{in: "1120" + v2Hash, err: true}, // not sha-256
+		{in: "1214" + v2Hash, err: true}, // wrong digest length
+		{in: "1220" + v2Hash[:62], err: true},
+		{in: "1220" + hexHash, err: true}, // v1 hash in a btmh
+		{in: "xyz", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMultihash(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseMultihash(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("magnet:?xt=urn:btih:" + hexHash + "&dn=Movie&tr=udp://tracker")
+	f.Add("magnet:?xt=urn:btih:" + base32Hash)
+	f.Add("magnet:?xt=urn:btmh:1220" + v2Hash)
+	f.Add("magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:1220" + v2Hash)
+	f.Add("magnet:?xt.1=urn:btih:" + hexHash + "&xt.2=urn:btmh:1220" + v2Hash + "&xl=1000")
+	f.Fuzz(func(t *testing.T, uri string) {
+		m, err := Parse(uri)
+		if err != nil {
+			return
+		}
+		if !hexInfoHash.MatchString(m.InfoHash) {
+			t.Fatalf("Parse(%q) returned info hash %q", uri, m.InfoHash)
+		}
+	})
+}
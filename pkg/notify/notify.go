@@ -0,0 +1,244 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"goBlack/common"
+	"goBlack/pkg"
+	"log/slog"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type EventType string
+
+const (
+	Submitted       EventType = "submitted"
+	CachedMiss      EventType = "cached_miss"
+	Downloaded      EventType = "downloaded"
+	Linked          EventType = "linked"
+	Failed          EventType = "failed"
+	AccountExpiring EventType = "account_expiring"
+
+	defaultRetries = 3
+	sendTimeout    = 30 * time.Second
+)
+
+// retryBackoff is the wait before the first retry, it doubles after that
+var retryBackoff = 2 * time.Second
+
+var defaultTemplates = map[EventType]string{
+	Submitted:       `{{.Name}} was sent to {{.Debrid}}`,
+	CachedMiss:      `{{.Name}} is not cached on {{.Debrid}}`,
+	Downloaded:      `{{.Name}} finished downloading on {{.Debrid}}`,
+	Linked:          `{{.Name}} is ready for {{.Arr}}`,
+	Failed:          `{{.Name}} failed: {{.Error}}`,
+	AccountExpiring: `{{.Debrid}} account expires in {{.Message}}`,
+}
+
+// Event is something that happened to a torrent or an account
+type Event struct {
+	Type      EventType `json:"event"`
+	Time      time.Time `json:"time"`
+	Arr       string    `json:"arr,omitempty"`
+	Debrid    string    `json:"debrid,omitempty"`
+	TorrentId string    `json:"torrent_id,omitempty"`
+	InfoHash  string    `json:"info_hash,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// Sender delivers a message to one kind of service
+type Sender interface {
+	Send(ctx context.Context, event Event, title, message string) error
+}
+
+type target struct {
+	name     string
+	sender   Sender
+	events   map[EventType]bool
+	template *template.Template
+	retries  int
+}
+
+// Notifier sends events to every target interested in them
+type Notifier struct {
+	targets []*target
+	wg      sync.WaitGroup
+}
+
+var (
+	defaultNotifier = &Notifier{}
+	defaultMu       sync.RWMutex
+)
+
+func New(configs []common.NotificationConfig) (*Notifier, error) {
+	n := &Notifier{}
+	for i, conf := range configs {
+		t, err := newTarget(conf)
+		if err != nil {
+			return nil, fmt.Errorf("notifications[%d]: %w", i, err)
+		}
+		n.targets = append(n.targets, t)
+	}
+	return n, nil
+}
+
+func newTarget(conf common.NotificationConfig) (*target, error) {
+	tr, err := common.NewTransport(conf.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	transport := common.WithTransport(tr)
+	var sender Sender
+	switch strings.ToLower(conf.Type) {
+	case "webhook":
+		sender, err = NewWebhook(conf.URL, transport)
+	case "discord":
+		sender, err = NewDiscord(conf.URL, transport)
+	case "ntfy":
+		sender, err = NewNtfy(conf.URL, conf.Token, transport)
+	case "gotify":
+		sender, err = NewGotify(conf.URL, conf.Token, transport)
+	default:
+		return nil, fmt.Errorf("unknown notification type: %s", conf.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &target{
+		name:    conf.Type,
+		sender:  sender,
+		retries: conf.Retries,
+	}
+	if t.retries <= 0 {
+		t.retries = defaultRetries
+	}
+	if len(conf.Events) > 0 {
+		t.events = make(map[EventType]bool, len(conf.Events))
+		for _, e := range conf.Events {
+			eventType := EventType(e)
+			if _, ok := defaultTemplates[eventType]; !ok {
+				return nil, fmt.Errorf("unknown event: %s", e)
+			}
+			t.events[eventType] = true
+		}
+	}
+	if conf.Template != "" {
+		tmpl, err := template.New(conf.Type).Parse(conf.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %w", err)
+		}
+		t.template = tmpl
+	}
+	return t, nil
+}
+
+// Setup replaces the notifier used by Notify
+func Setup(configs []common.NotificationConfig) error {
+	n, err := New(configs)
+	if err != nil {
+		return err
+	}
+	SetNotifier(n)
+	return nil
+}
+
+// SetNotifier replaces the notifier used by Notify with one built already
+func SetNotifier(n *Notifier) {
+	defaultMu.Lock()
+	defaultNotifier = n
+	defaultMu.Unlock()
+}
+
+// Notify sends an event through the notifier set up with Setup
+func Notify(event Event) {
+	defaultMu.RLock()
+	n := defaultNotifier
+	defaultMu.RUnlock()
+	n.Notify(event)
+}
+
+// Notify sends an event to the interested targets in the background
+func (n *Notifier) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, t := range n.targets {
+		if t.events != nil && !t.events[event.Type] {
+			continue
+		}
+		n.wg.Add(1)
+		go func(t *target) {
+			defer n.wg.Done()
+			t.deliver(event)
+		}(t)
+	}
+}
+
+// Wait blocks until every notification sent so far was delivered or given up on
+func (n *Notifier) Wait() {
+	n.wg.Wait()
+}
+
+func (t *target) deliver(event Event) {
+	message, err := t.render(event)
+	if err != nil {
+		slog.Error("Error rendering notification", "target", t.name, "event", event.Type, "error", err)
+		return
+	}
+	title := "Blackhole: " + strings.ReplaceAll(string(event.Type), "_", " ")
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err = t.sender.Send(ctx, event, title, message)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt >= t.retries {
+			slog.Error("Error sending notification", "target", t.name, "event", event.Type, "error", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (t *target) render(event Event) (string, error) {
+	tmpl := t.template
+	if tmpl == nil {
+		var err error
+		tmpl, err = template.New(string(event.Type)).Parse(defaultTemplates[event.Type])
+		if err != nil {
+			return "", err
+		}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// TorrentEvent builds an event about a torrent
+func TorrentEvent(eventType EventType, torrent *pkg.Torrent, err error) Event {
+	event := Event{
+		Type:      eventType,
+		TorrentId: torrent.Id,
+		InfoHash:  torrent.InfoHash,
+		Name:      torrent.Name,
+	}
+	if torrent.Arr != nil {
+		event.Arr = torrent.Arr.Name
+		event.Debrid = torrent.Arr.Debrid.Name
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
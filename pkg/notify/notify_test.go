@@ -0,0 +1,229 @@
+package notify
+
+import (
+	"encoding/json"
+	"goBlack/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request is what a stub server received
+type request struct {
+	path   string
+	header http.Header
+	body   map[string]any
+}
+
+// stub records the requests it gets and answers the first failures with a 503
+type stub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	requests []request
+}
+
+func newStub(t *testing.T, failures int) *stub {
+	s := &stub{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		req := request{path: r.URL.Path, header: r.Header.Clone()}
+		if err := json.Unmarshal(data, &req.body); err != nil {
+			t.Errorf("body is not JSON: %s", data)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, req)
+		if s.failures > 0 {
+			s.failures--
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stub) received() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// send delivers an event through a notifier for one target and waits for it
+func send(t *testing.T, conf common.NotificationConfig, events ...Event) {
+	t.Helper()
+	n, err := New([]common.NotificationConfig{conf})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, event := range events {
+		n.Notify(event)
+	}
+	n.Wait()
+}
+
+var failed = Event{
+	Type:   Failed,
+	Time:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	Arr:    "sonarr",
+	Debrid: "realdebrid",
+	Name:   "Show.S01E01",
+	Error:  "torrent is not cached",
+}
+
+func TestWebhook(t *testing.T) {
+	s := newStub(t, 0)
+	send(t, common.NotificationConfig{Type: "webhook", URL: s.URL + "/hook"}, failed)
+
+	reqs := s.received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if req.path != "/hook" || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s with content type %q", req.path, req.header.Get("Content-Type"))
+	}
+	want := map[string]any{
+		"event":   "failed",
+		"arr":     "sonarr",
+		"name":    "Show.S01E01",
+		"error":   "torrent is not cached",
+		"title":   "Blackhole: failed",
+		"message": "Show.S01E01 failed: torrent is not cached",
+	}
+	for key, value := range want {
+		if req.body[key] != value {
+			t.Errorf("%s = %v, want %v", key, req.body[key], value)
+		}
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	s := newStub(t, 0)
+	send(t, common.NotificationConfig{Type: "discord", URL: s.URL}, failed)
+
+	reqs := s.received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	embeds, _ := reqs[0].body["embeds"].([]any)
+	if len(embeds) != 1 {
+		t.Fatalf("got embeds %v", reqs[0].body["embeds"])
+	}
+	embed := embeds[0].(map[string]any)
+	if embed["title"] != "Blackhole: failed" || embed["description"] != "Show.S01E01 failed: torrent is not cached" {
+		t.Errorf("got embed %v", embed)
+	}
+	if embed["color"] != float64(eventColors[Failed]) || embed["timestamp"] != "2024-05-01T12:00:00Z" {
+		t.Errorf("got color %v and timestamp %v", embed["color"], embed["timestamp"])
+	}
+	if fields, _ := embed["fields"].([]any); len(fields) != 2 {
+		t.Errorf("got fields %v, want arr and debrid", embed["fields"])
+	}
+}
+
+func TestNtfy(t *testing.T) {
+	s := newStub(t, 0)
+	send(t, common.NotificationConfig{Type: "ntfy", URL: s.URL + "/downloads", Token: "tk_secret"}, failed)
+
+	reqs := s.received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if req.path != "/" {
+		t.Errorf("posted to %s, want the server root", req.path)
+	}
+	if got := req.header.Get("Authorization"); got != "Bearer tk_secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+	if req.body["topic"] != "downloads" || req.body["priority"] != float64(4) {
+		t.Errorf("got topic %v and priority %v", req.body["topic"], req.body["priority"])
+	}
+	if tags, _ := req.body["tags"].([]any); len(tags) != 1 || tags[0] != "x" {
+		t.Errorf("got tags %v", req.body["tags"])
+	}
+}
+
+func TestGotify(t *testing.T) {
+	s := newStub(t, 0)
+	send(t, common.NotificationConfig{Type: "gotify", URL: s.URL, Token: "app-token"}, failed)
+
+	reqs := s.received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if req.path != "/message" {
+		t.Errorf("posted to %s, want /message", req.path)
+	}
+	if got := req.header.Get("X-Gotify-Key"); got != "app-token" {
+		t.Errorf("X-Gotify-Key = %q", got)
+	}
+	if req.body["title"] != "Blackhole: failed" || req.body["priority"] != float64(8) {
+		t.Errorf("got %v", req.body)
+	}
+}
+
+func TestGotifyNeedsToken(t *testing.T) {
+	if _, err := New([]common.NotificationConfig{{Type: "gotify", URL: "http://gotify"}}); err == nil {
+		t.Fatal("gotify without a token was accepted")
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	s := newStub(t, 0)
+	linked := Event{Type: Linked, Name: "Movie", Arr: "radarr"}
+	send(t, common.NotificationConfig{Type: "webhook", URL: s.URL, Events: []string{"linked"}}, failed, linked)
+
+	reqs := s.received()
+	if len(reqs) != 1 || reqs[0].body["event"] != "linked" {
+		t.Fatalf("got %v, want only the linked event", reqs)
+	}
+	if _, err := New([]common.NotificationConfig{{Type: "webhook", URL: s.URL, Events: []string{"exploded"}}}); err == nil {
+		t.Error("an unknown event was accepted")
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	s := newStub(t, 0)
+	conf := common.NotificationConfig{
+		Type:     "webhook",
+		URL:      s.URL,
+		Template: `[{{.Arr}}] {{.Name}} ({{.Type}})`,
+	}
+	send(t, conf, failed)
+
+	reqs := s.received()
+	if len(reqs) != 1 || reqs[0].body["message"] != "[sonarr] Show.S01E01 (failed)" {
+		t.Fatalf("got %v", reqs)
+	}
+	conf.Template = "{{.Name"
+	if _, err := New([]common.NotificationConfig{conf}); err == nil {
+		t.Error("an invalid template was accepted")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = backoff })
+
+	t.Run("delivered after a 5xx", func(t *testing.T) {
+		s := newStub(t, 1)
+		send(t, common.NotificationConfig{Type: "webhook", URL: s.URL, Retries: 2}, failed)
+		if got := len(s.received()); got != 2 {
+			t.Fatalf("got %d attempts, want 2", got)
+		}
+	})
+	t.Run("given up after the retries", func(t *testing.T) {
+		s := newStub(t, 10)
+		send(t, common.NotificationConfig{Type: "webhook", URL: s.URL, Retries: 2}, failed)
+		if got := len(s.received()); got != 3 {
+			t.Fatalf("got %d attempts, want 3", got)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"goBlack/common"
+	"io"
+	"net/http"
+	gourl "net/url"
+	"strings"
+)
+
+var eventColors = map[EventType]int{
+	Submitted:       0x3498db,
+	CachedMiss:      0xf1c40f,
+	Downloaded:      0x2ecc71,
+	Linked:          0x2ecc71,
+	Failed:          0xe74c3c,
+	AccountExpiring: 0xe67e22,
+}
+
+var ntfyTags = map[EventType]string{
+	Submitted:       "inbox_tray",
+	CachedMiss:      "hourglass",
+	Downloaded:      "white_check_mark",
+	Linked:          "link",
+	Failed:          "x",
+	AccountExpiring: "warning",
+}
+
+func newClient(headers map[string]string, opts []common.ClientOption) *common.RLHTTPClient {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers["Content-Type"] = "application/json"
+	client := common.NewRLHTTPClient(nil, headers, opts...)
+	// Targets retry as many times as their config says
+	client.SetRetryPolicy(common.RetryPolicy{MaxAttempts: 1})
+	return client
+}
+
+func postJSON(ctx context.Context, client *common.RLHTTPClient, url string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	client.ApplyHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func checkURL(url string) error {
+	u, err := gourl.Parse(url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must start with http:// or https://: %s", url)
+	}
+	return nil
+}
+
+// Webhook posts the event as JSON
+type Webhook struct {
+	url    string
+	client *common.RLHTTPClient
+}
+
+func NewWebhook(url string, opts ...common.ClientOption) (*Webhook, error) {
+	if err := checkURL(url); err != nil {
+		return nil, err
+	}
+	return &Webhook{url: url, client: newClient(nil, opts)}, nil
+}
+
+func (w *Webhook) Send(ctx context.Context, event Event, title, message string) error {
+	body := struct {
+		Event
+		Title   string `json:"title"`
+		Message string `json:"message"`
+	}{event, title, message}
+	return postJSON(ctx, w.client, w.url, body)
+}
+
+// Discord posts an embed to a Discord webhook
+type Discord struct {
+	url    string
+	client *common.RLHTTPClient
+}
+
+func NewDiscord(url string, opts ...common.ClientOption) (*Discord, error) {
+	if err := checkURL(url); err != nil {
+		return nil, err
+	}
+	return &Discord{url: url, client: newClient(nil, opts)}, nil
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Timestamp   string         `json:"timestamp"`
+	Fields      []discordField `json:"fields,omitempty"`
+}
+
+func (d *Discord) Send(ctx context.Context, event Event, title, message string) error {
+	embed := discordEmbed{
+		Title:       title,
+		Description: message,
+		Color:       eventColors[event.Type],
+		Timestamp:   event.Time.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	if event.Arr != "" {
+		embed.Fields = append(embed.Fields, discordField{Name: "Arr", Value: event.Arr, Inline: true})
+	}
+	if event.Debrid != "" {
+		embed.Fields = append(embed.Fields, discordField{Name: "Debrid", Value: event.Debrid, Inline: true})
+	}
+	body := map[string]any{
+		"embeds": []discordEmbed{embed},
+	}
+	return postJSON(ctx, d.client, d.url, body)
+}
+
+// Ntfy publishes to an ntfy topic
+type Ntfy struct {
+	server string
+	topic  string
+	client *common.RLHTTPClient
+}
+
+func NewNtfy(url, token string, opts ...common.ClientOption) (*Ntfy, error) {
+	if err := checkURL(url); err != nil {
+		return nil, err
+	}
+	u, _ := gourl.Parse(url)
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("ntfy url must end with the topic: %s", url)
+	}
+	u.Path = "/"
+	var headers map[string]string
+	if token != "" {
+		headers = map[string]string{"Authorization": "Bearer " + token}
+	}
+	return &Ntfy{server: u.String(), topic: topic, client: newClient(headers, opts)}, nil
+}
+
+func (n *Ntfy) Send(ctx context.Context, event Event, title, message string) error {
+	priority := 3
+	if event.Type == Failed || event.Type == AccountExpiring {
+		priority = 4
+	}
+	body := map[string]any{
+		"topic":    n.topic,
+		"title":    title,
+		"message":  message,
+		"priority": priority,
+		"tags":     []string{ntfyTags[event.Type]},
+	}
+	return postJSON(ctx, n.client, n.server, body)
+}
+
+// Gotify sends a message to a Gotify server
+type Gotify struct {
+	url    string
+	client *common.RLHTTPClient
+}
+
+func NewGotify(url, token string, opts ...common.ClientOption) (*Gotify, error) {
+	if err := checkURL(url); err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("gotify needs an app token")
+	}
+	endpoint, err := gourl.JoinPath(url, "message")
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{"X-Gotify-Key": token}
+	return &Gotify{url: endpoint, client: newClient(headers, opts)}, nil
+}
+
+func (g *Gotify) Send(ctx context.Context, event Event, title, message string) error {
+	priority := 4
+	if event.Type == Failed || event.Type == AccountExpiring {
+		priority = 8
+	}
+	body := map[string]any{
+		"title":    title,
+		"message":  message,
+		"priority": priority,
+	}
+	return postJSON(ctx, g.client, g.url, body)
+}
@@ -0,0 +1,282 @@
+package selector
+
+import (
+	"fmt"
+	"goBlack/common"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// File is a file of a torrent as seen by the selector
+type File struct {
+	Id   string
+	Path string
+	Size int64
+}
+
+// Preset is the set of file types an arr can import. Media files are subject to
+// the size, sample and largest-only rules, companion files are kept next to
+// them as long as at least one media file is kept.
+type Preset struct {
+	Media     *regexp.Regexp
+	Companion *regexp.Regexp
+	Exclude   []*regexp.Regexp
+}
+
+var (
+	// Extras are matched on folder names and the -trailer style suffixes Plex
+	// uses, words in a file name are too often part of the title
+	extrasFolderMatch = regexp.MustCompile(`(?i)(^|[\\/])(trailers?|featurettes?|extras|behind[._ \-]the[._ \-]scenes|deleted[._ \-]scenes|interviews?)[\\/]`)
+	extrasSuffixMatch = regexp.MustCompile(`(?i)-(trailer|featurette|behindthescenes|deleted|interview|scene|short)\.[^.\\/]+$`)
+	sampleMatch       = regexp.MustCompile(`(?i)(^|[\\/._ \-\[(])samples?([\\/._ \-\])]|$)`)
+
+	Presets = map[string]Preset{
+		"video": {
+			Media:     regexp.MustCompile(common.VIDEOMATCH),
+			Companion: regexp.MustCompile(common.SUBMATCH),
+			Exclude:   []*regexp.Regexp{extrasFolderMatch, extrasSuffixMatch},
+		},
+		"audio": {
+			Media:     regexp.MustCompile(`(?i)\.(FLAC|MP3|M4A|AAC|OGG|OPUS|WAV|WV|APE|ALAC|AIFF?|DSF|WMA)$`),
+			Companion: regexp.MustCompile(`(?i)\.(CUE|LRC)$`),
+		},
+		"books": {
+			Media: regexp.MustCompile(`(?i)\.(EPUB|MOBI|AZW3?|PDF|CBZ|CBR|DJVU|FB2|M4B)$`),
+		},
+		"all": {},
+	}
+)
+
+// Selector applies the file selection rules of an arr
+type Selector struct {
+	preset       Preset
+	include      []string
+	exclude      []string
+	includeRegex []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+	minSize      int64
+	maxSize      int64
+	skipSamples  bool
+	largestOnly  bool
+}
+
+func New(conf common.SelectionConfig) (*Selector, error) {
+	name := strings.ToLower(conf.Preset)
+	if name == "" {
+		name = "video"
+	}
+	preset, ok := Presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown selection preset: %s", conf.Preset)
+	}
+	s := &Selector{
+		preset:      preset,
+		skipSamples: conf.SkipSamples == nil || *conf.SkipSamples,
+		largestOnly: conf.LargestOnly,
+	}
+	for _, glob := range conf.Include {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid include glob %q: %w", glob, err)
+		}
+		s.include = append(s.include, strings.ToLower(glob))
+	}
+	for _, glob := range conf.Exclude {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude glob %q: %w", glob, err)
+		}
+		s.exclude = append(s.exclude, strings.ToLower(glob))
+	}
+	for _, expr := range conf.IncludeRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include regex %q: %w", expr, err)
+		}
+		s.includeRegex = append(s.includeRegex, re)
+	}
+	for _, expr := range conf.ExcludeRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude regex %q: %w", expr, err)
+		}
+		s.excludeRegex = append(s.excludeRegex, re)
+	}
+	var err error
+	if s.minSize, err = ParseSize(conf.MinSize); err != nil {
+		return nil, fmt.Errorf("invalid min_size: %w", err)
+	}
+	if s.maxSize, err = ParseSize(conf.MaxSize); err != nil {
+		return nil, fmt.Errorf("invalid max_size: %w", err)
+	}
+	return s, nil
+}
+
+// Select returns the files that should be downloaded, in their original order
+func (s *Selector) Select(files []File) []File {
+	media := make([]File, 0, len(files))
+	companions := make([]File, 0)
+	var largest int64
+	for _, f := range files {
+		if !s.allowed(f.Path) {
+			continue
+		}
+		switch {
+		case s.isMedia(f.Path):
+			if !s.sizeAllowed(f.Size) {
+				continue
+			}
+			media = append(media, f)
+			largest = max(largest, f.Size)
+		case s.preset.Companion != nil && s.preset.Companion.MatchString(f.Path):
+			companions = append(companions, f)
+		}
+	}
+
+	if s.skipSamples {
+		kept := media[:0]
+		for _, f := range media {
+			if !IsSample(f, largest) {
+				kept = append(kept, f)
+			}
+		}
+		media = kept
+	}
+	if len(media) == 0 {
+		return nil
+	}
+	if s.largestOnly {
+		for _, f := range media {
+			if f.Size == largest {
+				media = []File{f}
+				break
+			}
+		}
+	}
+
+	keep := make(map[string]bool, len(media)+len(companions))
+	for _, f := range media {
+		keep[f.Id] = true
+	}
+	for _, f := range companions {
+		keep[f.Id] = true
+	}
+	selected := make([]File, 0, len(keep))
+	for _, f := range files {
+		if keep[f.Id] {
+			selected = append(selected, f)
+		}
+	}
+	return selected
+}
+
+// Accepts reports whether any file of the list would be selected
+func (s *Selector) Accepts(files []File) bool {
+	return len(s.Select(files)) > 0
+}
+
+func (s *Selector) isMedia(filePath string) bool {
+	if s.preset.Media == nil {
+		// The "all" preset treats every file as media
+		return true
+	}
+	return s.preset.Media.MatchString(filePath)
+}
+
+// allowed applies the include and exclude rules to a path
+func (s *Selector) allowed(filePath string) bool {
+	for _, re := range s.preset.Exclude {
+		if re.MatchString(filePath) {
+			return false
+		}
+	}
+	for _, glob := range s.exclude {
+		if matchGlob(glob, filePath) {
+			return false
+		}
+	}
+	for _, re := range s.excludeRegex {
+		if re.MatchString(filePath) {
+			return false
+		}
+	}
+	if len(s.include) == 0 && len(s.includeRegex) == 0 {
+		return true
+	}
+	for _, glob := range s.include {
+		if matchGlob(glob, filePath) {
+			return true
+		}
+	}
+	for _, re := range s.includeRegex {
+		if re.MatchString(filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Selector) sizeAllowed(size int64) bool {
+	if s.minSize > 0 && size < s.minSize {
+		return false
+	}
+	if s.maxSize > 0 && size > s.maxSize {
+		return false
+	}
+	return true
+}
+
+// IsSample reports whether a file looks like a sample of the largest file.
+// The name has to say so and the file has to be much smaller, so a film that is
+// actually called "Sample" is not dropped.
+func IsSample(f File, largest int64) bool {
+	return sampleMatch.MatchString(f.Path) && f.Size*5 < largest
+}
+
+// matchGlob matches a lower case glob on the file name, or on the whole path if
+// the glob contains a /
+func matchGlob(glob, filePath string) bool {
+	filePath = strings.ToLower(strings.TrimPrefix(filePath, "/"))
+	if !strings.Contains(glob, "/") {
+		filePath = path.Base(filePath)
+	}
+	ok, _ := path.Match(strings.TrimPrefix(glob, "/"), filePath)
+	return ok
+}
+
+var sizeMatch = regexp.MustCompile(`(?i)^\s*([\d.]+)\s*([kmgt]?i?b?)\s*$`)
+
+// ParseSize parses sizes such as 700MB or 1.5GiB into bytes. Units are powers of 1000,
+// or of 1024 with an i. An empty string is 0.
+func ParseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	matches := sizeMatch.FindStringSubmatch(size)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	unit := strings.ToUpper(matches[2])
+	base := 1000.0
+	if strings.Contains(unit, "I") {
+		base = 1024
+	}
+	multiplier := 1.0
+	if unit != "" && unit != "B" {
+		switch unit[0] {
+		case 'K':
+			multiplier = base
+		case 'M':
+			multiplier = base * base
+		case 'G':
+			multiplier = base * base * base
+		case 'T':
+			multiplier = base * base * base * base
+		}
+	}
+	return int64(value * multiplier), nil
+}
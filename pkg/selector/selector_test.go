@@ -0,0 +1,220 @@
+package selector
+
+import (
+	"goBlack/common"
+	"reflect"
+	"testing"
+)
+
+const (
+	mb = 1000 * 1000
+	gb = 1000 * mb
+)
+
+func selectIds(t *testing.T, conf common.SelectionConfig, files []File) []string {
+	t.Helper()
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var ids []string
+	for _, f := range s.Select(files) {
+		ids = append(ids, f.Id)
+	}
+	return ids
+}
+
+func TestSelect(t *testing.T) {
+	no := false
+	tests := []struct {
+		name  string
+		conf  common.SelectionConfig
+		files []File
+		want  []string
+	}{
+		{
+			name: "video preset keeps media and subtitles",
+			files: []File{
+				{Id: "1", Path: "/Movie.2020/Movie.2020.mkv", Size: 4 * gb},
+				{Id: "2", Path: "/Movie.2020/Movie.2020.en.srt", Size: 50_000},
+				{Id: "3", Path: "/Movie.2020/Movie.2020.nfo", Size: 1000},
+			},
+			want: []string{"1", "2"},
+		},
+		{
+			name: "subtitles alone are not enough",
+			files: []File{
+				{Id: "1", Path: "/Movie.2020/Movie.2020.en.srt", Size: 50_000},
+			},
+			want: nil,
+		},
+		{
+			name: "audio preset",
+			conf: common.SelectionConfig{Preset: "audio"},
+			files: []File{
+				{Id: "1", Path: "/Album/01.flac", Size: 30 * mb},
+				{Id: "2", Path: "/Album/album.cue", Size: 1000},
+				{Id: "3", Path: "/Album/cover.jpg", Size: mb},
+			},
+			want: []string{"1", "2"},
+		},
+		{
+			name: "books preset",
+			conf: common.SelectionConfig{Preset: "books"},
+			files: []File{
+				{Id: "1", Path: "/Book/book.epub", Size: mb},
+				{Id: "2", Path: "/Book/book.mkv", Size: gb},
+			},
+			want: []string{"1"},
+		},
+		{
+			name: "all preset keeps everything",
+			conf: common.SelectionConfig{Preset: "all"},
+			files: []File{
+				{Id: "1", Path: "/a.bin", Size: 10},
+				{Id: "2", Path: "/b.nfo", Size: 10},
+			},
+			want: []string{"1", "2"},
+		},
+		{
+			name: "extras folders and suffixes are dropped",
+			files: []File{
+				{Id: "1", Path: "/Movie/Movie.mkv", Size: 4 * gb},
+				{Id: "2", Path: "/Movie/Extras/Making.Of.mkv", Size: 500 * mb},
+				{Id: "3", Path: "/Movie/Featurettes/Cast.mkv", Size: 500 * mb},
+				{Id: "4", Path: "/Movie/Movie-trailer.mkv", Size: 100 * mb},
+				{Id: "5", Path: "/Movie/Behind The Scenes/Day1.mkv", Size: 500 * mb},
+			},
+			want: []string{"1"},
+		},
+		{
+			name: "titles that contain extras words are kept",
+			files: []File{
+				{Id: "1", Path: "/Trailer.Park.Boys.S01/Trailer.Park.Boys.S01E01.mkv", Size: gb},
+				{Id: "2", Path: "/Extras.S01E01.mkv", Size: gb},
+				{Id: "3", Path: "/The.Interview.2014.1080p/The.Interview.2014.1080p.mkv", Size: 8 * gb},
+			},
+			want: []string{"1", "2", "3"},
+		},
+		{
+			name: "include glob on the name",
+			conf: common.SelectionConfig{Include: []string{"*E01*"}},
+			files: []File{
+				{Id: "1", Path: "/Show/Show.S01E01.mkv", Size: gb},
+				{Id: "2", Path: "/Show/Show.S01E02.mkv", Size: gb},
+			},
+			want: []string{"1"},
+		},
+		{
+			name: "exclude glob on the path",
+			conf: common.SelectionConfig{Exclude: []string{"show/season 2/*"}},
+			files: []File{
+				{Id: "1", Path: "/Show/Season 1/Show.S01E01.mkv", Size: gb},
+				{Id: "2", Path: "/Show/Season 2/Show.S02E01.mkv", Size: gb},
+			},
+			want: []string{"1"},
+		},
+		{
+			name: "include and exclude regexes",
+			conf: common.SelectionConfig{
+				IncludeRegex: []string{`S01E0[1-3]`},
+				ExcludeRegex: []string{`E02`},
+			},
+			files: []File{
+				{Id: "1", Path: "/Show.S01E01.mkv", Size: gb},
+				{Id: "2", Path: "/Show.S01E02.mkv", Size: gb},
+				{Id: "3", Path: "/Show.S01E03.mkv", Size: gb},
+				{Id: "4", Path: "/Show.S01E04.mkv", Size: gb},
+			},
+			want: []string{"1", "3"},
+		},
+		{
+			name: "min and max size",
+			conf: common.SelectionConfig{MinSize: "100MB", MaxSize: "2GB"},
+			files: []File{
+				{Id: "1", Path: "/small.mkv", Size: 50 * mb},
+				{Id: "2", Path: "/fine.mkv", Size: gb},
+				{Id: "3", Path: "/huge.mkv", Size: 3 * gb},
+			},
+			want: []string{"2"},
+		},
+		{
+			name: "samples are skipped",
+			files: []File{
+				{Id: "1", Path: "/Movie/Movie.mkv", Size: 4 * gb},
+				{Id: "2", Path: "/Movie/Sample/movie-sample.mkv", Size: 50 * mb},
+			},
+			want: []string{"1"},
+		},
+		{
+			name: "a film called sample is kept",
+			files: []File{
+				{Id: "1", Path: "/Sample.2019/Sample.2019.mkv", Size: 4 * gb},
+			},
+			want: []string{"1"},
+		},
+		{
+			name: "samples kept when skip_samples is off",
+			conf: common.SelectionConfig{SkipSamples: &no},
+			files: []File{
+				{Id: "1", Path: "/Movie/Movie.mkv", Size: 4 * gb},
+				{Id: "2", Path: "/Movie/Sample/movie-sample.mkv", Size: 50 * mb},
+			},
+			want: []string{"1", "2"},
+		},
+		{
+			name: "largest only keeps companions",
+			conf: common.SelectionConfig{LargestOnly: true},
+			files: []File{
+				{Id: "1", Path: "/Movie/Movie.CD1.mkv", Size: 2 * gb},
+				{Id: "2", Path: "/Movie/Movie.CD2.mkv", Size: 3 * gb},
+				{Id: "3", Path: "/Movie/Movie.srt", Size: 50_000},
+			},
+			want: []string{"2", "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectIds(t, tt.conf, tt.files); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidRules(t *testing.T) {
+	for _, conf := range []common.SelectionConfig{
+		{Preset: "games"},
+		{Include: []string{"["}},
+		{ExcludeRegex: []string{"("}},
+		{MinSize: "big"},
+	} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("New(%+v) accepted invalid rules", conf)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"700", 700},
+		{"700B", 700},
+		{"700MB", 700 * mb},
+		{"1.5GB", 1500 * mb},
+		{"1GiB", 1 << 30},
+		{"2 kib", 2048},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error("ParseSize accepted an invalid size")
+	}
+}
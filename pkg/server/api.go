@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goBlack/pkg"
+	"goBlack/pkg/debrid"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	maxTorrentSize   = 10 << 20
+)
+
+var (
+	// ErrConflict means the torrent isn't in a state that allows the action
+	ErrConflict   = errors.New("conflict")
+	ErrUnknownArr = errors.New("unknown arr")
+)
+
+// Jobs runs torrents on behalf of the API
+type Jobs interface {
+	Submit(arr string, torrent *pkg.Torrent) error
+	Retry(id string) error
+	Cancel(id string) error
+	Delete(id string) error
+}
+
+type submitRequest struct {
+	Arr    string `json:"arr"`
+	Magnet string `json:"magnet"`
+}
+
+type submitResponse struct {
+	Id       string `json:"id"`
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name"`
+	Arr      string `json:"arr"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// SetJobs enables the endpoints that start and stop torrents
+func (s *Server) SetJobs(jobs Jobs) {
+	s.jobs = jobs
+}
+
+func (s *Server) registerAPI() {
+	s.mux.Handle("GET /api/accounts", s.authenticate(s.handleAccounts))
+	s.mux.Handle("GET /api/stats", s.authenticate(s.handleStats))
+	s.mux.Handle("GET /api/torrents", s.authenticate(s.handleListTorrents))
+	s.mux.Handle("POST /api/torrents", s.authenticate(s.handleSubmitTorrent))
+	s.mux.Handle("GET /api/torrents/{id}", s.authenticate(s.handleGetTorrent))
+	s.mux.Handle("DELETE /api/torrents/{id}", s.authenticate(s.handleDeleteTorrent))
+	s.mux.Handle("POST /api/torrents/{id}/retry", s.authenticate(s.handleRetryTorrent))
+	s.mux.Handle("POST /api/torrents/{id}/cancel", s.authenticate(s.handleCancelTorrent))
+}
+
+// authenticate lets requests through if they carry the API key, either as
+// X-Api-Key or as a bearer token
+func (s *Server) authenticate(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.apiKey == "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("the api is disabled, set server.api_key to enable it"))
+			return
+		}
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid api key"))
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (s *Server) handleListTorrents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := pkg.Filter{
+		Status: query.Get("status"),
+		Arr:    query.Get("arr"),
+		Limit:  defaultListLimit,
+	}
+	var err error
+	if v := query.Get("active"); v != "" {
+		if filter.Active, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid active: %s", v))
+			return
+		}
+	}
+	if filter.Since, err = parseTime(query.Get("since")); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since: %w", err))
+		return
+	}
+	if filter.Until, err = parseTime(query.Get("until")); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid until: %w", err))
+		return
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %s", v))
+			return
+		}
+		filter.Limit = min(filter.Limit, maxListLimit)
+	}
+	if v := query.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %s", v))
+			return
+		}
+	}
+	records, err := pkg.ListTorrents(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := pkg.GetStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateOnly, value, time.Local)
+}
+
+func (s *Server) handleGetTorrent(w http.ResponseWriter, r *http.Request) {
+	record, err := pkg.GetTorrent(r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// handleSubmitTorrent takes a magnet as JSON, or a magnet or .torrent file as
+// a multipart form with the arr in the "arr" field
+func (s *Server) handleSubmitTorrent(w http.ResponseWriter, r *http.Request) {
+	if s.jobs == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("not ready"))
+		return
+	}
+	var (
+		req     submitRequest
+		torrent *pkg.Torrent
+		err     error
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		torrent, req.Arr, err = readSubmitForm(r)
+	} else {
+		if err = json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&req); err == nil {
+			torrent, err = debrid.ParseMagnet(req.Magnet)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.jobs.Submit(req.Arr, torrent); err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, submitResponse{
+		Id:       torrent.Id,
+		InfoHash: torrent.InfoHash,
+		Name:     torrent.Name,
+		Arr:      req.Arr,
+	})
+}
+
+func readSubmitForm(r *http.Request) (*pkg.Torrent, string, error) {
+	if err := r.ParseMultipartForm(maxTorrentSize); err != nil {
+		return nil, "", err
+	}
+	arr := r.FormValue("arr")
+	if magnetLink := r.FormValue("magnet"); magnetLink != "" {
+		torrent, err := debrid.ParseMagnet(magnetLink)
+		return torrent, arr, err
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, "", fmt.Errorf("a magnet or a file is required")
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxTorrentSize))
+	if err != nil {
+		return nil, "", err
+	}
+	torrent, err := debrid.ParseTorrentFile(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid torrent file: %w", err)
+	}
+	return torrent, arr, nil
+}
+
+func (s *Server) handleRetryTorrent(w http.ResponseWriter, r *http.Request) {
+	s.runJobAction(w, r, Jobs.Retry, http.StatusAccepted)
+}
+
+func (s *Server) handleCancelTorrent(w http.ResponseWriter, r *http.Request) {
+	s.runJobAction(w, r, Jobs.Cancel, http.StatusAccepted)
+}
+
+func (s *Server) handleDeleteTorrent(w http.ResponseWriter, r *http.Request) {
+	s.runJobAction(w, r, Jobs.Delete, http.StatusNoContent)
+}
+
+func (s *Server) runJobAction(w http.ResponseWriter, r *http.Request, action func(Jobs, string) error, status int) {
+	if s.jobs == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("not ready"))
+		return
+	}
+	if err := action(s.jobs, r.PathValue("id")); err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, pkg.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrConflict):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrUnknownArr):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
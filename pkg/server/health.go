@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"goBlack/common"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const checkTimeout = 10 * time.Second
+
+// Check reports whether a dependency is usable
+type Check func(ctx context.Context) error
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status   string                 `json:"status"`
+	Checks   map[string]CheckResult `json:"checks,omitempty"`
+	Circuits []common.CircuitStatus `json:"circuits,omitempty"` // hosts requests were sent to
+}
+
+// AddCheck registers a dependency check run by /readyz
+func (s *Server) AddCheck(name string, check Check) {
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	s.checks[name] = check
+}
+
+// RemoveCheck unregisters a check, for a dependency that went away
+func (s *Server) RemoveCheck(name string) {
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	delete(s.checks, name)
+}
+
+// RunChecks runs every registered check at once and reports whether all passed
+func (s *Server) RunChecks(ctx context.Context) (map[string]CheckResult, bool) {
+	s.checksMu.Lock()
+	checks := make(map[string]Check, len(s.checks))
+	for name, check := range s.checks {
+		checks[name] = check
+	}
+	s.checksMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]CheckResult, len(checks))
+		ok      = true
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			err := runCheck(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				results[name] = CheckResult{Status: "fail", Error: err.Error()}
+				ok = false
+				return
+			}
+			results[name] = CheckResult{Status: "ok"}
+		}(name, check)
+	}
+	wg.Wait()
+	return results, ok
+}
+
+// runCheck gives up on checks that don't return before the context is done
+func runCheck(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok", Circuits: common.Circuits()})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	results, ok := s.RunChecks(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "fail", Checks: results, Circuits: common.Circuits()})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok", Checks: results, Circuits: common.Circuits()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"goBlack/common"
+	"goBlack/pkg/debrid"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server exposes blackhole's own HTTP endpoints
+type Server struct {
+	Address  string
+	mux      *http.ServeMux
+	checksMu sync.Mutex
+	checks   map[string]Check
+	accounts []*debrid.AccountMonitor
+	apiKey   string
+	jobs     Jobs
+}
+
+func New(conf common.ServerConfig) *Server {
+	s := &Server{
+		Address: conf.Address,
+		mux:     http.NewServeMux(),
+		checks:  make(map[string]Check),
+		apiKey:  conf.APIKey,
+	}
+	s.mux.Handle("GET /metrics", promhttp.Handler())
+	s.mux.HandleFunc("GET /healthz", s.handleHealthz)
+	s.mux.HandleFunc("GET /readyz", s.handleReadyz)
+	s.registerAPI()
+	s.mux.Handle("GET /", webHandler())
+	return s
+}
+
+// AddAccount exposes the state of a debrid account on the API
+func (s *Server) AddAccount(monitor *debrid.AccountMonitor) {
+	s.accounts = append(s.accounts, monitor)
+}
+
+func (s *Server) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]debrid.AccountStatus, 0, len(s.accounts))
+	for _, monitor := range s.accounts {
+		statuses = append(statuses, monitor.Status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// Start serves in the background, a failure to listen is logged and not fatal
+func (s *Server) Start() {
+	go func() {
+		slog.Info("Listening", "address", s.Address)
+		err := http.ListenAndServe(s.Address, s.mux)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error starting server", "address", s.Address, "error", err)
+		}
+	}()
+}
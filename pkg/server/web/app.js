@@ -0,0 +1,196 @@
+"use strict";
+
+const REFRESH = 5000;
+const KEY = "blackhole.apiKey";
+
+let timer = null;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+// el builds an element, strings become text so torrent names are never parsed as HTML
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    if (name.startsWith("on")) {
+      node.addEventListener(name.slice(2), value);
+    } else {
+      node.setAttribute(name, value);
+    }
+  }
+  for (const child of children) {
+    node.append(child instanceof Node ? child : String(child ?? ""));
+  }
+  return node;
+}
+
+function formatBytes(bytes) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (bytes >= 1000 && i < units.length - 1) {
+    bytes /= 1000;
+    i++;
+  }
+  return `${bytes.toFixed(i ? 1 : 0)} ${units[i]}`;
+}
+
+function formatTime(value) {
+  const date = new Date(value);
+  return date.getTime() > 0 ? date.toLocaleString() : "";
+}
+
+async function api(method, path) {
+  const resp = await fetch(`api/${path}`, {
+    method,
+    headers: { "X-Api-Key": localStorage.getItem(KEY) || "" },
+  });
+  if (resp.status === 401 || resp.status === 403) {
+    const body = await resp.json().catch(() => ({}));
+    showLogin(body.error || "Invalid API key");
+    throw new Error("unauthorized");
+  }
+  if (!resp.ok) {
+    const body = await resp.json().catch(() => ({}));
+    throw new Error(body.error || resp.statusText);
+  }
+  return resp.status === 204 ? null : resp.json();
+}
+
+function fill(tbody, rows, columns) {
+  if (rows.length === 0) {
+    rows = [el("tr", {}, el("td", { class: "empty", colspan: columns }, "Nothing here"))];
+  }
+  tbody.replaceChildren(...rows);
+}
+
+function action(label, cls, method, path, confirmText) {
+  return el("button", {
+    class: cls,
+    onclick: async () => {
+      if (confirmText && !confirm(confirmText)) {
+        return;
+      }
+      try {
+        await api(method, path);
+      } catch (err) {
+        if (err.message !== "unauthorized") {
+          alert(err.message);
+        }
+      }
+      refresh();
+    },
+  }, label);
+}
+
+function renderAccounts(accounts) {
+  $("accounts").replaceChildren(...accounts.map((status) => {
+    const card = el("div", { class: "card" }, el("strong", {}, status.debrid));
+    if (status.error) {
+      card.append(el("div", { class: "error" }, status.error));
+    }
+    const account = status.account;
+    if (account) {
+      card.append(
+        el("div", {}, account.username),
+        el("div", { class: account.premium ? "ok" : "error" },
+          account.premium ? `Premium until ${formatTime(account.expiration)}` : "No premium"),
+        el("div", {}, `${account.points} points, ${formatBytes(account.traffic_used)} used today`),
+      );
+    }
+    card.append(el("div", { class: "muted" }, `Checked ${formatTime(status.checked_at)}`));
+    return card;
+  }));
+}
+
+function renderStats(stats) {
+  fill($("stats"), stats.map((s) => el("tr", {},
+    el("td", {}, s.arr || "(unknown)"),
+    el("td", {}, s.active),
+    el("td", {}, s.completed),
+    el("td", {}, s.failed),
+    el("td", {}, s.cancelled),
+    el("td", {}, formatBytes(s.size)),
+  )), 6);
+}
+
+function renderActive(torrents) {
+  fill($("active"), torrents.map((t) => el("tr", {},
+    el("td", { class: "name" }, t.name),
+    el("td", {}, t.arr),
+    el("td", {}, t.status),
+    el("td", {}, el("progress", { max: 100, value: t.progress }), ` ${Math.round(t.progress)}%`),
+    el("td", {}, t.speed ? `${formatBytes(t.speed)}/s` : ""),
+    el("td", {}, t.seeders || ""),
+    el("td", {}, action("Cancel", "danger", "POST", `torrents/${t.id}/cancel`, `Cancel ${t.name}?`)),
+  )), 7);
+}
+
+function renderFailed(torrents) {
+  fill($("failed"), torrents.map((t) => el("tr", {},
+    el("td", { class: "name" }, t.name),
+    el("td", {}, t.arr),
+    el("td", {}, formatTime(t.updated_at)),
+    el("td", { class: "error" }, t.error),
+    el("td", {},
+      action("Retry", "primary", "POST", `torrents/${t.id}/retry`),
+      " ",
+      action("Remove", "danger", "DELETE", `torrents/${t.id}`, `Remove ${t.name} from the debrid and the history?`),
+    ),
+  )), 5);
+}
+
+async function refresh() {
+  clearTimeout(timer);
+  try {
+    const [accounts, stats, active, failed] = await Promise.all([
+      api("GET", "accounts"),
+      api("GET", "stats"),
+      api("GET", "torrents?active=true"),
+      api("GET", "torrents?status=failed&limit=20"),
+    ]);
+    renderAccounts(accounts);
+    renderStats(stats);
+    renderActive(active);
+    renderFailed(failed);
+    $("updated").textContent = `Updated ${new Date().toLocaleTimeString()}`;
+  } catch (err) {
+    if (err.message === "unauthorized") {
+      return;
+    }
+    $("updated").textContent = `Update failed: ${err.message}`;
+  }
+  timer = setTimeout(refresh, REFRESH);
+}
+
+function showLogin(message) {
+  clearTimeout(timer);
+  $("dashboard").hidden = true;
+  $("logout").hidden = true;
+  $("login").hidden = false;
+  $("login-error").textContent = message || "";
+}
+
+function showDashboard() {
+  $("login").hidden = true;
+  $("dashboard").hidden = false;
+  $("logout").hidden = false;
+  refresh();
+}
+
+$("login").addEventListener("submit", (event) => {
+  event.preventDefault();
+  localStorage.setItem(KEY, $("key").value);
+  showDashboard();
+});
+
+$("logout").addEventListener("click", () => {
+  localStorage.removeItem(KEY);
+  showLogin();
+});
+
+if (localStorage.getItem(KEY)) {
+  showDashboard();
+} else {
+  showLogin();
+}
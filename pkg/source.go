@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"os"
+	"sync"
+)
+
+// Source is a watch file that one or more torrents were read from. It is only
+// removed once every torrent read from it is done.
+type Source struct {
+	Path     string
+	mu       sync.Mutex
+	pending  int
+	keep     bool
+	finished func()
+}
+
+// NewSource returns the source of a number of torrents, finished is called
+// once all of them are done and the file was removed or kept
+func NewSource(path string, jobs int, finished func()) *Source {
+	return &Source{
+		Path:     path,
+		pending:  jobs,
+		finished: finished,
+	}
+}
+
+// Done marks one of the torrents of the source as finished. The file is kept if
+// any of them asked not to remove it.
+func (s *Source) Done(remove bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	s.keep = s.keep || !remove
+	if s.pending > 0 {
+		return
+	}
+	if s.finished != nil {
+		defer s.finished()
+	}
+	if s.keep {
+		return
+	}
+	err := os.Remove(s.Path)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,295 @@
+package pkg
+
+import (
+	"database/sql"
+	"errors"
+	"goBlack/common"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("torrent not found")
+	errInterrupted = errors.New("blackhole stopped before the torrent finished")
+)
+
+// Record is a torrent as saved in the database
+type Record struct {
+	Id          string    `json:"id"`
+	DebridId    string    `json:"debrid_id,omitempty"`
+	InfoHash    string    `json:"info_hash"`
+	Name        string    `json:"name"`
+	Folder      string    `json:"folder,omitempty"`
+	Filename    string    `json:"filename,omitempty"`
+	Size        int64     `json:"size"`
+	Magnet      string    `json:"magnet"`
+	Arr         string    `json:"arr"`
+	WatchFolder string    `json:"watch_folder"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Progress    float64   `json:"progress"`
+	Speed       int64     `json:"speed"`
+	Seeders     int       `json:"seeders"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Files       []File    `json:"files,omitempty"`
+	History     []Change  `json:"history,omitempty"`
+}
+
+// Change is an entry in the status history of a torrent
+type Change struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// ArrStats counts the torrents of an arr by outcome
+type ArrStats struct {
+	Arr       string `json:"arr"`
+	Total     int    `json:"total"`
+	Active    int    `json:"active"`
+	Completed int    `json:"completed"`
+	Failed    int    `json:"failed"`
+	Cancelled int    `json:"cancelled"`
+	Size      int64  `json:"size"` // of completed torrents
+}
+
+// Filter narrows down ListTorrents, zero values match everything
+type Filter struct {
+	Status string
+	Active bool // only torrents that haven't completed, failed or been cancelled
+	Arr    string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
+
+// finalStatuses is a SQL list of the statuses a torrent ends in
+const finalStatuses = `('` + StatusCompleted + `', '` + StatusFailed + `', '` + StatusCancelled + `')`
+
+const recordColumns = `id, COALESCE(debrid_id, ''), COALESCE(info_hash, ''), COALESCE(name, ''),
+	COALESCE(folder, ''), COALESCE(filename, ''), COALESCE(size, 0), COALESCE(magnet, ''),
+	COALESCE(arr, ''), COALESCE(watch_folder, ''), COALESCE(status, ''), COALESCE(error, ''),
+	COALESCE(progress, 0), COALESCE(speed, 0), COALESCE(seeders, 0),
+	COALESCE(created_at, 0), COALESCE(updated_at, 0)`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRecord(row scanner) (*Record, error) {
+	var (
+		r                    Record
+		createdAt, updatedAt int64
+	)
+	err := row.Scan(&r.Id, &r.DebridId, &r.InfoHash, &r.Name, &r.Folder, &r.Filename, &r.Size, &r.Magnet,
+		&r.Arr, &r.WatchFolder, &r.Status, &r.Error, &r.Progress, &r.Speed, &r.Seeders, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	r.CreatedAt = time.Unix(createdAt, 0)
+	r.UpdatedAt = time.Unix(updatedAt, 0)
+	return &r, nil
+}
+
+// ListTorrents returns the torrents matching the filter, newest first
+func ListTorrents(filter Filter) ([]Record, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Active {
+		where = append(where, "COALESCE(status, '') NOT IN "+finalStatuses)
+	}
+	if filter.Arr != "" {
+		where = append(where, "arr = ?")
+		args = append(args, filter.Arr)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until.Unix())
+	}
+	query := "SELECT " + recordColumns + " FROM torrent"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id"
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+	rows, err := common.GetDB().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]Record, 0)
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *r)
+	}
+	return records, rows.Err()
+}
+
+// GetTorrent returns a torrent with its files and status history
+func GetTorrent(id string) (*Record, error) {
+	db := common.GetDB()
+	r, err := scanRecord(db.QueryRow("SELECT "+recordColumns+" FROM torrent WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT id, name, size, path FROM file WHERE torrent_id = ? ORDER BY rowid`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.Id, &f.Name, &f.Size, &f.Path); err != nil {
+			return nil, err
+		}
+		r.Files = append(r.Files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	history, err := db.Query(`
+		SELECT status, COALESCE(error, ''), created_at FROM torrent_history WHERE torrent_id = ? ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer history.Close()
+	for history.Next() {
+		var (
+			c  Change
+			at int64
+		)
+		if err := history.Scan(&c.Status, &c.Error, &at); err != nil {
+			return nil, err
+		}
+		c.Time = time.Unix(at, 0)
+		r.History = append(r.History, c)
+	}
+	return r, history.Err()
+}
+
+// DeleteTorrent removes a torrent, its files and its history from the database
+func DeleteTorrent(id string) error {
+	res, err := common.GetDB().Exec(`DELETE FROM torrent WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetStats returns the torrent counts of every arr
+func GetStats() ([]ArrStats, error) {
+	rows, err := common.GetDB().Query(`
+		SELECT COALESCE(arr, ''), COALESCE(status, ''), COUNT(*), COALESCE(SUM(size), 0)
+		FROM torrent GROUP BY 1, 2 ORDER BY 1
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make([]ArrStats, 0)
+	for rows.Next() {
+		var (
+			arr, status string
+			count       int
+			size        int64
+		)
+		if err := rows.Scan(&arr, &status, &count, &size); err != nil {
+			return nil, err
+		}
+		if len(stats) == 0 || stats[len(stats)-1].Arr != arr {
+			stats = append(stats, ArrStats{Arr: arr})
+		}
+		s := &stats[len(stats)-1]
+		s.Total += count
+		switch status {
+		case StatusCompleted:
+			s.Completed += count
+			s.Size += size
+		case StatusFailed:
+			s.Failed += count
+		case StatusCancelled:
+			s.Cancelled += count
+		default:
+			s.Active += count
+		}
+	}
+	return stats, rows.Err()
+}
+
+// HandledHashes returns the info hashes read from a watch file since it was
+// written that completed or are still being processed. A watch file kept for
+// a failed torrent is read again, its other torrents must not be sent twice.
+func HandledHashes(filename string, since time.Time) (map[string]bool, error) {
+	rows, err := common.GetDB().Query(`
+		SELECT DISTINCT info_hash FROM torrent
+		WHERE filename = ? AND created_at >= ? AND (status = ? OR COALESCE(status, '') NOT IN `+finalStatuses+`)
+	`, filename, since.Unix(), StatusCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes[hash] = true
+	}
+	return hashes, rows.Err()
+}
+
+// FailInterrupted marks torrents that were still being processed when
+// blackhole stopped as failed, so they can be retried
+func FailInterrupted() (int, error) {
+	rows, err := common.GetDB().Query(`SELECT id, COALESCE(status, '') FROM torrent WHERE COALESCE(status, '') NOT IN ` + finalStatuses)
+	if err != nil {
+		return 0, err
+	}
+	var torrents []*Torrent
+	for rows.Next() {
+		t := &Torrent{}
+		if err := rows.Scan(&t.Id, &t.Status); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		torrents = append(torrents, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, t := range torrents {
+		if err := t.SetStatus(StatusFailed, errInterrupted); err != nil {
+			return 0, err
+		}
+	}
+	return len(torrents), nil
+}
@@ -1,24 +1,41 @@
 package pkg
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"goBlack/common"
-	"log"
+	"goBlack/pkg/selector"
+	"log/slog"
 	"net/http"
 	gourl "net/url"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+// Statuses set by blackhole, the others come from the debrid
+const (
+	StatusPending   = "pending"
+	StatusLinking   = "linking"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
 )
 
 type Arr struct {
+	Name            string              `json:"name"`
 	WatchFolder     string              `json:"watch_folder"`
 	CompletedFolder string              `json:"completed_folder"`
 	Debrid          common.DebridConfig `json:"debrid"`
 	Token           string              `json:"token"`
 	URL             string              `json:"url"`
 	Client          *common.RLHTTPClient
+	Selector        *selector.Selector
+	Archives        string
 }
 
 type ArrHistorySchema struct {
@@ -87,17 +104,30 @@ func (arr *Arr) GetHistory(downloadId, eventType string) *ArrHistorySchema {
 }
 
 type Torrent struct {
-	Id       string `json:"id"`
-	InfoHash string `json:"info_hash"`
-	Name     string `json:"name"`
-	Folder   string `json:"folder"`
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-	Magnet   string `json:"magnet"`
-	Files    []File `json:"files"`
-	Status   string `json:"status"`
+	Id       string   `json:"id"`
+	DebridId string   `json:"debrid_id"`
+	InfoHash string   `json:"info_hash"`
+	Name     string   `json:"name"`
+	Folder   string   `json:"folder"`
+	Filename string   `json:"filename"`
+	Size     int64    `json:"size"`
+	Magnet   string   `json:"magnet"`
+	Trackers []string `json:"trackers"`
+	Files    []File   `json:"files"`
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	Progress float64  `json:"progress"`
+	Speed    int64    `json:"speed"`
+	Seeders  int      `json:"seeders"`
+	Extract  bool     `json:"extract"` // files are archives to unpack instead of link
+	Data     []byte   `json:"-"`       // contents of the .torrent file, empty for magnets
+
+	Arr    *Arr
+	Source *Source
 
-	Arr *Arr
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type File struct {
@@ -107,12 +137,46 @@ type File struct {
 	Path string `json:"path"`
 }
 
+// NewTorrentId returns a random id for a new job
+func NewTorrentId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Logger returns a logger with the fields that identify the torrent
+func (t *Torrent) Logger() *slog.Logger {
+	logger := slog.With("torrent_id", t.Id, "info_hash", t.InfoHash)
+	if t.DebridId != "" {
+		logger = logger.With("debrid_id", t.DebridId)
+	}
+	if t.Arr != nil {
+		logger = logger.With("arr", t.Arr.Name, "debrid", t.Arr.Debrid.Name)
+	}
+	return logger
+}
+
+func (t *Torrent) initContext() {
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+}
+
+// Context is cancelled when the job is cancelled
+func (t *Torrent) Context() context.Context {
+	t.once.Do(t.initContext)
+	return t.ctx
+}
+
+// Cancel stops the job at its next wait
+func (t *Torrent) Cancel() {
+	t.once.Do(t.initContext)
+	t.cancel()
+}
+
+// Cleanup releases the watch file the torrent was read from. Torrents submitted
+// through the API or retried have none.
 func (t *Torrent) Cleanup(remove bool) {
-	if remove {
-		err := os.Remove(t.Filename)
-		if err != nil {
-			return
-		}
+	if t.Source != nil {
+		t.Source.Done(remove)
 	}
 }
 
@@ -129,39 +193,89 @@ func (t *Torrent) UpsertDB() error {
 	}(tx)
 
 	// Insert or update torrent
+	now := time.Now().Unix()
 	_, err = tx.Exec(`
-		INSERT INTO torrent (id, info_hash, name, folder, filename, size, magnet, watch_folder, status)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO torrent (id, debrid_id, info_hash, name, folder, filename, size, magnet, watch_folder, arr, status, error, progress, speed, seeders, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(id) DO UPDATE SET
+		debrid_id = excluded.debrid_id,
 		info_hash = excluded.info_hash,
 		name = excluded.name,
 		folder = excluded.folder,
 		filename = excluded.filename,
 		size = excluded.size,
-		magnet = excluded.magnet
-	`, t.Id, t.InfoHash, t.Name, t.Folder, t.Filename, t.Size, t.Magnet, t.Arr.WatchFolder, t.Status)
+		magnet = excluded.magnet,
+		arr = excluded.arr,
+		status = excluded.status,
+		error = excluded.error,
+		progress = excluded.progress,
+		speed = excluded.speed,
+		seeders = excluded.seeders,
+		updated_at = excluded.updated_at
+	`, t.Id, t.DebridId, t.InfoHash, t.Name, t.Folder, t.Filename, t.Size, t.Magnet, t.Arr.WatchFolder, t.Arr.Name, t.Status, t.Error, t.Progress, t.Speed, t.Seeders, now, now)
 	if err != nil {
 		return err
 	}
 
-	// Insert or update files
+	// Replace the files, the list shrinks once files are selected
+	_, err = tx.Exec(`DELETE FROM file WHERE torrent_id = ?`, t.Id)
+	if err != nil {
+		return err
+	}
 	for _, file := range t.Files {
 		_, err = tx.Exec(`
 			INSERT INTO file (id, name, size, path, torrent_id)
 			VALUES (?, ?, ?, ?, ?)
-			ON CONFLICT(id) DO UPDATE SET
-			name = excluded.name,
-			size = excluded.size,
-			path = excluded.path,
-			torrent_id = excluded.torrent_id
 		`, file.Id, file.Name, file.Size, file.Path, t.Id)
 		if err != nil {
 			return err
 		}
 	}
+	return tx.Commit()
+}
+
+// UpdateProgress saves the download state reported by the debrid
+func (t *Torrent) UpdateProgress() error {
+	_, err := common.GetDB().Exec(`
+		UPDATE torrent SET progress = ?, speed = ?, seeders = ?, updated_at = ? WHERE id = ?
+	`, t.Progress, t.Speed, t.Seeders, time.Now().Unix(), t.Id)
 	return err
 }
 
+// SetStatus saves a new status and adds it to the history of the torrent. The
+// error is the reason for a failure, nil otherwise.
+func (t *Torrent) SetStatus(status string, reason error) error {
+	if status == t.Status {
+		return nil
+	}
+	t.Status = status
+	t.Error = ""
+	if reason != nil {
+		t.Error = reason.Error()
+	}
+	now := time.Now().Unix()
+	tx, err := common.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	_, err = tx.Exec(`
+		UPDATE torrent SET status = ?, error = ?, updated_at = ? WHERE id = ?
+	`, t.Status, t.Error, now, t.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO torrent_history (torrent_id, status, error, created_at) VALUES (?, ?, ?, ?)
+	`, t.Id, t.Status, t.Error, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (t *Torrent) MarkAsFailed() error {
 	downloadId := strings.ToUpper(t.InfoHash)
 	history := t.Arr.GetHistory(downloadId, "grabbed")
@@ -182,7 +296,7 @@ func (t *Torrent) MarkAsFailed() error {
 		}
 		_, err = t.Arr.Client.MakeRequest(http.MethodPost, url, nil)
 		if err == nil {
-			log.Printf("Marked torrent: %s as failed", t.Name)
+			t.Logger().Info("Marked torrent as failed in arr")
 		}
 	}
 	return nil